@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// tinyLFU is a TinyLFU-style frequency estimator used as the admission filter.
+// It keeps approximate access counts of recently requested keys using a
+// count-min sketch of 4-bit counters, fronted by a doorkeeper bloom filter that
+// absorbs the first access to each key so that one-hit wonders never reach the
+// sketch. All counters are halved every time the number of recorded accesses
+// reaches the window size, so that old popularity fades out.
+type tinyLFU struct {
+	mu        sync.Mutex
+	sketch    []uint64 // 16 4-bit counters per word
+	door      []uint64 // doorkeeper bit set
+	mask      uint64   // mask for counter and bit indexes
+	additions int
+	window    int
+}
+
+// tinyLFUDepth is the number of counters per key in the count-min sketch.
+const tinyLFUDepth = 4
+
+// newTinyLFU creates a tinyLFU filter that tracks roughly the given number of
+// recent accesses.
+func newTinyLFU(window int) *tinyLFU {
+	n := 64
+	for n < window {
+		n <<= 1
+	}
+	return &tinyLFU{
+		sketch: make([]uint64, n/16),
+		door:   make([]uint64, n/64),
+		mask:   uint64(n - 1),
+		window: window,
+	}
+}
+
+// indexes returns the counter indexes for the hash.
+func (f *tinyLFU) indexes(hash Hash) (idx [tinyLFUDepth]uint64) {
+	var h uint64
+	for i := 0; i < HashSize; i += 8 {
+		h ^= binary.BigEndian.Uint64(hash[i:])
+	}
+	h1 := mix64(h)
+	h2 := mix64(h1) | 1
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & f.mask
+	}
+	return
+}
+
+// record records an access to the key identified by the hash.
+func (f *tinyLFU) record(hash Hash) {
+	idx := f.indexes(hash)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.inDoor(idx) {
+		for _, i := range idx {
+			f.door[i>>6] |= 1 << (i & 63)
+		}
+	} else {
+		for _, i := range idx {
+			w, sh := i>>4, (i&15)<<2
+			if (f.sketch[w]>>sh)&0xf != 0xf {
+				f.sketch[w] += 1 << sh
+			}
+		}
+	}
+
+	f.additions++
+	if f.window <= f.additions {
+		f.reset()
+	}
+}
+
+// estimate returns the estimated number of recent accesses to the key
+// identified by the hash.
+func (f *tinyLFU) estimate(hash Hash) int {
+	idx := f.indexes(hash)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.inDoor(idx) {
+		return 0
+	}
+	n := 0xf
+	for _, i := range idx {
+		if v := int((f.sketch[i>>4] >> ((i & 15) << 2)) & 0xf); v < n {
+			n = v
+		}
+	}
+	return n + 1
+}
+
+// inDoor reports whether all the bits for the indexes are set in the
+// doorkeeper. It must be called with f.mu held.
+func (f *tinyLFU) inDoor(idx [tinyLFUDepth]uint64) bool {
+	for _, i := range idx {
+		if f.door[i>>6]&(1<<(i&63)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reset halves all the counters and clears the doorkeeper. It must be called
+// with f.mu held.
+func (f *tinyLFU) reset() {
+	for i, w := range f.sketch {
+		f.sketch[i] = (w >> 1) & 0x7777777777777777
+	}
+	for i := range f.door {
+		f.door[i] = 0
+	}
+	f.additions >>= 1
+}
+
+// mix64 is the finalizer of SplitMix64, used to spread the hash bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
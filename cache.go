@@ -6,18 +6,16 @@ package filecache
 
 import (
 	"context"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/petar/GoLLRB/llrb"
 	"github.com/tunabay/go-infounit"
 )
 
@@ -27,44 +25,88 @@ type Cache[K Key] struct {
 	create     CreateFunc[K]
 	maxFiles   uint64
 	maxSize    infounit.ByteCount
+	lowFiles   uint64
+	lowSize    infounit.ByteCount
+	minFree    infounit.ByteCount
+	minFreePct float64
 	maxAge     time.Duration
 	gcInterval time.Duration
-
-	numFiles     uint64
-	totalSize    infounit.ByteCount
-	numRequested uint64
-	numHit       uint64
-	numCreated   uint64
-	numFailed    uint64
-	numRemoved   uint64
-
-	opMap  map[Hash]*opEntry
-	refMap map[Hash]int
-	cond   *sync.Cond
-	mu     sync.Mutex
+	tmpMaxAge  time.Duration
+	touchIntvl time.Duration
+	checkIntvl time.Duration
+	eviction   EvictionPolicy
+	shared     bool
+	createLock bool
+	durable    bool
+	autoServe  bool
+	asyncScan  bool
+	scanConc   int
+	exclPinned bool
+	evictRefd  bool
+
+	numFiles      atomic.Uint64
+	totalSize     atomic.Uint64 // in bytes
+	numRequested  atomic.Uint64
+	numHit        atomic.Uint64
+	numCreated    atomic.Uint64
+	numFailed     atomic.Uint64
+	numRemoved    atomic.Uint64
+	numRejected   atomic.Uint64
+	numTmpRemoved atomic.Uint64
+	numScanned    atomic.Uint64 // cache files found by the startup scan so far
+	numPinned     atomic.Uint64 // pinned files currently in cache
+	pinnedSize    atomic.Uint64 // total size of pinned files currently in cache
+	numOps        atomic.Int64
+	numRefs       atomic.Int64
+	numFileRefs   atomic.Int64  // number of File objects referencing cache files
+	pendingSize   atomic.Uint64 // size of removed files still referenced
+
+	hitHist    histogram // latency of Get for cache hits
+	createHist histogram // time taken by CreateFunc
+	waitHist   histogram // time waiting for concurrent creation
+	sizeHist   histogram // size of files currently in cache
+
+	filter *tinyLFU
+
+	shards    [numShards]shard
+	inflation atomic.Uint64 // GreedyDual-Size inflation value, in float64 bits
+	gcWake    chan struct{}
+	ready     chan struct{} // closed when the startup scan completes
+
+	nextExpiry atomic.Int64 // when the next expiry pass is due, in unix nanoseconds
+
+	gcMu        sync.Mutex   // serializes GC passes and synchronous evictions
+	cands       []*candidate // left by the last scan, protected by gcMu
+	lastCollect time.Time    // when the last scan started, protected by gcMu
+
+	sizeHint  func(K) infounit.ByteCount
+	hardLimit bool
+	reserved  infounit.ByteCount // total size reserved by in-flight creations
+	resCond   *sync.Cond
+	resMu     sync.Mutex
+	commitMu  sync.Mutex // serializes commits with HardLimit
+
+	pinMu sync.Mutex // serializes the changes of pins to be saved
+
+	prioFunc  func(K) Priority
+	prioDirty atomic.Bool // priorities changed since the last save
+	prioMu    sync.Mutex  // serializes the saves of priorities
+
+	closed   atomic.Bool
+	closing  chan struct{}         // closed by Close
+	active   sync.WaitGroup        // in-flight creations and Serve
+	creating map[*os.File]struct{} // files being written by CreateFunc
+	canceled bool                  // in-flight creations canceled by Close
+	closeMu  sync.Mutex
+
+	onEvent   func(*Event[K])
+	onGCError func(error)
 
 	log      Logger
+	slog     *slog.Logger
 	debugLog bool
 }
 
-func (c *Cache[_]) ref(hash Hash) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	v := c.refMap[hash]
-	c.refMap[hash] = v + 1
-}
-
-func (c *Cache[K]) unref(hash Hash) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	v := c.refMap[hash]
-	if v == 1 {
-		delete(c.refMap, hash)
-	} else {
-		c.refMap[hash] = v - 1
-	}
-}
-
 // CreateFunc represents a function for file creation. It will be called when
 // Get is called for a new key that does not exist in the cache. It should
 // create the file using the pre-opened file argument passed. It does not have
@@ -91,10 +133,36 @@ func NewWithConfig[K Key](conf *Config[K]) (*Cache[K], error) {
 		return nil, fmt.Errorf("%w: empty Dir", ErrInvalidConfig)
 	case conf.Create == nil:
 		return nil, fmt.Errorf("%w: nil Create", ErrInvalidConfig)
+	case conf.MaxFiles < conf.LowFiles:
+		return nil, fmt.Errorf("%w: LowFiles greater than MaxFiles", ErrInvalidConfig)
+	case conf.MaxSize < conf.LowSize:
+		return nil, fmt.Errorf("%w: LowSize greater than MaxSize", ErrInvalidConfig)
+	case conf.MinFreePercent < 0 || 100 < conf.MinFreePercent:
+		return nil, fmt.Errorf("%w: MinFreePercent out of range", ErrInvalidConfig)
+	case (conf.MinFreeSpace != 0 || conf.MinFreePercent != 0) && !diskSpaceSupported:
+		return nil, fmt.Errorf("%w: MinFreeSpace not supported on this platform", ErrInvalidConfig)
 	case conf.MaxAge < 0:
 		return nil, fmt.Errorf("%w: negative MaxAge", ErrInvalidConfig)
 	case conf.GCInterval < 0:
 		return nil, fmt.Errorf("%w: negative GCInterval", ErrInvalidConfig)
+	case conf.TmpMaxAge < 0:
+		return nil, fmt.Errorf("%w: negative TmpMaxAge", ErrInvalidConfig)
+	case conf.TouchInterval < 0:
+		return nil, fmt.Errorf("%w: negative TouchInterval", ErrInvalidConfig)
+	case conf.CheckInterval < 0:
+		return nil, fmt.Errorf("%w: negative CheckInterval", ErrInvalidConfig)
+	case conf.ScanConcurrency < 0:
+		return nil, fmt.Errorf("%w: negative ScanConcurrency", ErrInvalidConfig)
+	case conf.AdmissionWindow < 0:
+		return nil, fmt.Errorf("%w: negative AdmissionWindow", ErrInvalidConfig)
+	case EvictGreedyDual < conf.Eviction:
+		return nil, fmt.Errorf("%w: unknown Eviction %d", ErrInvalidConfig, conf.Eviction)
+	case conf.Shared && !lockSupported:
+		return nil, fmt.Errorf("%w: Shared not supported on this platform", ErrInvalidConfig)
+	case conf.EvictReferenced && !unlinkOpenSupported:
+		return nil, fmt.Errorf("%w: EvictReferenced not supported on this platform", ErrInvalidConfig)
+	case conf.EvictReferenced && conf.Shared:
+		return nil, fmt.Errorf("%w: EvictReferenced with Shared", ErrInvalidConfig)
 	}
 
 	c := &Cache[K]{
@@ -102,20 +170,69 @@ func NewWithConfig[K Key](conf *Config[K]) (*Cache[K], error) {
 		create:     conf.Create,
 		maxFiles:   conf.MaxFiles,
 		maxSize:    conf.MaxSize,
+		lowFiles:   conf.LowFiles,
+		lowSize:    conf.LowSize,
+		minFree:    conf.MinFreeSpace,
+		minFreePct: conf.MinFreePercent,
 		maxAge:     conf.MaxAge,
 		gcInterval: conf.GCInterval,
-
-		opMap:  make(map[Hash]*opEntry),
-		refMap: make(map[Hash]int),
+		tmpMaxAge:  conf.TmpMaxAge,
+		touchIntvl: conf.TouchInterval,
+		checkIntvl: conf.CheckInterval,
+		eviction:   conf.Eviction,
+		shared:     conf.Shared,
+		createLock: conf.CreateLock || conf.Shared,
+		durable:    conf.Durable,
+		autoServe:  conf.AutoServe,
+		asyncScan:  conf.AsyncScan,
+		scanConc:   conf.ScanConcurrency,
+		exclPinned: conf.ExcludePinnedSize,
+		evictRefd:  conf.EvictReferenced,
+
+		gcWake:   make(chan struct{}, 1),
+		ready:    make(chan struct{}),
+		closing:  make(chan struct{}),
+		creating: make(map[*os.File]struct{}),
+
+		sizeHint:  conf.SizeHint,
+		hardLimit: conf.HardLimit,
+
+		prioFunc: conf.Priority,
+
+		onEvent:   conf.OnEvent,
+		onGCError: conf.OnGCError,
 
 		log:      conf.Logger,
+		slog:     conf.Slog,
 		debugLog: conf.DebugLog,
 	}
-	c.cond = sync.NewCond(&c.mu)
+	for i := range c.shards {
+		c.shards[i].init()
+	}
+	c.resCond = sync.NewCond(&c.resMu)
 
+	if c.lowFiles == 0 {
+		c.lowFiles = c.maxFiles
+	}
+	if c.lowSize == 0 {
+		c.lowSize = c.maxSize
+	}
 	if c.gcInterval == 0 {
 		c.gcInterval = defaultGCInterval
 	}
+	if c.tmpMaxAge == 0 {
+		c.tmpMaxAge = defaultTmpMaxAge
+	}
+	if conf.Admission {
+		window := conf.AdmissionWindow
+		if window == 0 {
+			window = defaultAdmissionWindow
+			if mf := conf.MaxFiles; uint64(window) < mf && mf < 1<<24 {
+				window = int(mf) * 8
+			}
+		}
+		c.filter = newTinyLFU(window)
+	}
 
 	if c.dir == "" {
 		c.dir = filepath.Base(os.Args[0])
@@ -131,224 +248,98 @@ func NewWithConfig[K Key](conf *Config[K]) (*Cache[K], error) {
 	if err := os.MkdirAll(c.dir, 0o0700); err != nil {
 		return nil, fmt.Errorf("%s: %w", c.dir, err)
 	}
-	c.logPrintf("Cache directory: %s", c.dir)
-
-	// read dir, count total size, total files.
-	var (
-		numRemoved  uint64
-		sizeRemoved infounit.ByteCount
-	)
-	walker := func(path string, d fs.DirEntry, err error) error {
-		switch {
-		case err != nil:
-			c.logPrintf("%s: Skip unreadable file.", path)
-			return fs.SkipDir
-		case d.IsDir():
-			return nil
-		}
-		fname := d.Name()
-		if len(fname) != HashSize*2 {
-			c.logPrintf("%s: Skip unexpected file in cache dir.", fname)
-			return nil
-		}
-		if _, err := hex.DecodeString(fname); err != nil {
-			c.logPrintf("%s: Skip unexpected file in cache dir.", fname)
-			return nil
-		}
-		finfo, err := d.Info()
-		sz := infounit.ByteCount(finfo.Size())
-		if err != nil {
-			c.logPrintf("%s: Failed to stat: %v", path, err)
-			return nil
-		}
-		age := time.Since(finfo.ModTime())
-		if c.maxAge < age {
-			if err := os.Remove(path); err != nil {
-				c.logPrintf("%s: Failed to remove expired cache: %v", path, err)
-				return nil
-			}
-			c.logPrintf("%s: Removed expired cache. size=%.1S, age=%v", fname, sz, age)
-			numRemoved++
-			sizeRemoved += sz
-			return nil
-		}
-		c.numFiles++
-		c.totalSize += sz
-		c.logDebugf("%s: Cache found. size=%.1S, age=%v", fname, sz, age)
+	c.logInfo("Cache directory.", slog.String("dir", c.dir))
 
-		return nil
+	if err := c.loadPins(); err != nil {
+		return nil, err
 	}
-	if err := filepath.WalkDir(c.dir, walker); err != nil {
-		c.logPrintf("%s: Failed to read cache dir: %v", c.dir, err)
-		return nil, fmt.Errorf("%s: failed to read cache dir: %w", c.dir, err)
+	if err := c.loadPriorities(); err != nil {
+		return nil, err
 	}
-	if numRemoved != 0 {
-		c.logPrintf("Removed %d expired cache files. total=%.1S", numRemoved, sizeRemoved)
+
+	if c.asyncScan {
+		for i := range c.shards {
+			c.shards[i].scanned = make(map[Hash]struct{})
+		}
+		c.active.Add(1)
+		go c.scanAsync()
+	} else {
+		if err := c.scan(); err != nil {
+			return nil, err
+		}
+		close(c.ready)
 	}
-	if c.numFiles != 0 {
-		c.logPrintf("Found %d cache files. total=%.1S", c.numFiles, c.totalSize)
+	if c.autoServe {
+		c.active.Add(1)
+		go c.serve(context.Background())
 	}
 
 	return c, nil
 }
 
-// Serve serves the Cache instance. It performs find and delete old cache files.
-func (c *Cache[K]) Serve(ctx context.Context) error {
-	rmCache := func(hash Hash, path string, lastMod time.Time) error {
-		c.mu.Lock()
-		if _, refed := c.refMap[hash]; refed {
-			c.mu.Unlock()
-			return nil // concurrently read
-		}
-		finfo, err := os.Stat(path)
-		if err != nil {
-			return nil // file disappeared?
-		}
-		if !lastMod.Equal(finfo.ModTime()) {
-			return nil // concurrently accessed
-		}
-		op := &opEntry{opType: 1, done: make(chan struct{})}
-		c.opMap[hash] = op
-		c.mu.Unlock()
-
-		if err := os.Remove(path); err != nil {
-			c.mu.Lock()
-			delete(c.opMap, hash)
-			c.mu.Unlock()
-			close(op.done)
-
-			return fmt.Errorf("%x: %w", hash[:], err)
-		}
-		c.logPrintf("%x: Removed.", hash[:]) // successfully removed
-
-		c.mu.Lock()
-		delete(c.opMap, hash)
-		c.numRemoved++
-		c.numFiles--
-		c.totalSize -= infounit.ByteCount(finfo.Size())
-		c.mu.Unlock()
-		close(op.done)
-
-		return nil
+// Remove removes the cached file for the key from the cache. It reports whether
+// the file existed and was removed. If the file is currently referenced by a
+// File not closed yet, it returns ErrReferenced without removing the file,
+// unless EvictReferenced is set.
+func (c *Cache[K]) Remove(key K) (bool, error) {
+	hash := key.Hash()
+	finfo, err := c.remove(hash)
+	if finfo == nil || err != nil {
+		return false, err
 	}
+	c.emit(&Event[K]{
+		Type:   EventRemoved,
+		Hash:   hash,
+		Key:    key,
+		HasKey: true,
+		Size:   infounit.ByteCount(finfo.Size()),
+		Age:    time.Since(finfo.ModTime()),
+	})
+
+	return true, nil
+}
+
+// remove removes the cache file for the hash. It returns the information of
+// the removed file, or nil if it does not exist.
+func (c *Cache[K]) remove(hash Hash) (fs.FileInfo, error) {
+	_, path := c.filePath(hash)
+	sh := c.shard(hash)
 
-	zeroCand := &candidate{}
 	for {
-		c.mu.Lock()
-		for c.numFiles <= c.maxFiles && c.totalSize <= c.maxSize && ctx.Err() == nil {
-			c.cond.Wait()
-		}
-		c.mu.Unlock()
-		if err := ctx.Err(); err != nil {
-			return nil
+		sh.mu.Lock()
+		if op, ok := sh.opMap[hash]; ok {
+			// concurrently being created or removed
+			sh.mu.Unlock()
+			<-op.done
+			continue
 		}
-
-		c.logDebugf("Started GC...")
-
-		// build candidates
-		var maxCands uint64 = 64
-		for c.numFiles+maxCands < c.maxFiles {
-			maxCands <<= 1
+		if _, refed := sh.refMap[hash]; refed && !c.evictRefd {
+			sh.mu.Unlock()
+			return nil, fmt.Errorf("%x: %w", hash[:], ErrReferenced)
 		}
-		tree := llrb.New()
-
-		walker := func(path string, d fs.DirEntry, err error) error {
-			switch {
-			case err != nil:
-				return fs.SkipDir
-			case d.IsDir():
-				return nil
-			}
-			fname := d.Name()
-			if len(fname) != HashSize*2 {
-				return nil
-			}
-			fhashb, err := hex.DecodeString(fname)
-			if err != nil {
-				return nil
-			}
-			var fhash Hash
-			copy(fhash[:], fhashb)
+		op := &opEntry{opType: opRemove, done: make(chan struct{})}
+		c.addOpLocked(sh, hash, op)
+		sh.removes++
+		sh.mu.Unlock()
 
-			finfo, err := d.Info()
-			if err != nil {
-				return nil
-			}
-			if age := time.Since(finfo.ModTime()); c.maxAge < age {
-				if err := rmCache(fhash, path, finfo.ModTime()); err != nil {
-					c.logPrintf("%s: Failed to remove expired cache: %v", path, err)
-				}
-				return nil
-			}
-			cand := &candidate{
-				hash:    fhash,
-				path:    path,
-				lastMod: finfo.ModTime(),
-			}
-			tree.InsertNoReplace(cand)
-			if maxCands < uint64(tree.Len()) {
-				tree.DeleteMax()
+		finfo, err := os.Stat(path)
+		if err != nil {
+			c.finishOp(hash, op)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
 			}
-			return nil
-		}
-		if err := filepath.WalkDir(c.dir, walker); err != nil {
-			continue // failed to read
+			return nil, fmt.Errorf("internal error, stat failed: %w", err)
 		}
 
-		candList := make([]*candidate, tree.Len())
-		n := 0
-		iterator := func(iif llrb.Item) bool {
-			candList[n] = iif.(*candidate) //nolint:forcetypeassert
-			n++
-			return true
+		sz := infounit.ByteCount(finfo.Size())
+		if err := c.unlinkFile(hash, path, sz, op); err != nil {
+			return nil, err
 		}
-		tree.AscendGreaterOrEqual(zeroCand, iterator)
-
-		for _, cand := range candList {
-			c.mu.Lock()
-			overflow := c.maxFiles < c.numFiles || c.maxSize < c.totalSize
-			if !overflow {
-				c.mu.Unlock()
-				break
-			}
-			c.mu.Unlock()
 
-			if err := rmCache(cand.hash, cand.path, cand.lastMod); err != nil {
-				c.logPrintf("%s: Failed to remove expired cache: %v", cand.path, err)
-				continue
-			}
-		}
-		c.logDebugf("GC finished.")
-
-		// wait for the next
-		timer := time.NewTimer(c.gcInterval)
-		select {
-		case <-ctx.Done():
-			if !timer.Stop() {
-				<-timer.C
-			}
-			return nil
-		case <-timer.C:
-		}
+		return finfo, nil
 	}
 }
 
-// candidate represents a candidate file for deletion in the cache directory.
-// Among these candidates, those with the oldest lastMod will be deleted in
-// order.
-type candidate struct {
-	hash    Hash
-	path    string
-	lastMod time.Time
-}
-
-// Less compares the lastMod values of the two candidates and reports the
-// result.
-func (c *candidate) Less(xif llrb.Item) bool {
-	x := xif.(*candidate) //nolint:forcetypeassert
-	return c.lastMod.Before(x.lastMod)
-}
-
 // Get gets the file for the key from the cache. If the file for the specified
 // key does not exist in the cache, it will call the CreateFunc to create the
 // new file. It returns the file opened for read, cached or not.
@@ -358,163 +349,282 @@ func (c *candidate) Less(xif llrb.Item) bool {
 // caller's responsibility to call the File.Close() method of the returned file.
 // Otherwise the file will remain in the cache, and the reference will remain in
 // the memory.
+//
+// If the admission filter is enabled and the newly created file is not
+// admitted into the cache, the returned file is a temporary file that is not
+// cached, and it is deleted when closed.
+//
+// It returns ErrClosed if the Cache has been closed.
 func (c *Cache[K]) Get(key K) (*File[K], bool, error) {
+	if c.closed.Load() {
+		return nil, false, ErrClosed
+	}
 	hash := key.Hash()
+	startedAt := time.Now()
+
+	c.logDebug("Requested.", logOp("get"), logHash(hash), logKey(key))
 
-	c.logDebugf("Get: key=%q", key.String())
+	c.numRequested.Add(1)
+	if c.filter != nil {
+		c.filter.record(hash)
+	}
 
 	dir, path := c.filePath(hash)
+	sh := c.shard(hash)
+
+	// unreserve releases the size reserved for the creation, if any.
+	var reserved infounit.ByteCount
+	unreserve := func() {
+		if reserved != 0 {
+			c.release(reserved)
+			reserved = 0
+		}
+	}
+
+	// fail finishes the failed creation operation.
+	fail := func(op *opEntry, err error) (*File[K], bool, error) {
+		unreserve()
+		op.err = err
+		c.numFailed.Add(1)
+		c.finishOp(hash, op)
+
+		return nil, false, err
+	}
 
 	var (
-		created bool
-		lastMod time.Time
+		created  bool
+		lastMod  time.Time
+		cost     time.Duration
+		openPath string
+		tmpFile  bool
+		waited   bool
+		osFile   *os.File
+		removals int
+		ref      *refEntry
 	)
-	for isRetry := false; ; isRetry = true {
-		c.mu.Lock()
-		if !isRetry {
-			c.numRequested++
-		}
-		op, ok := c.opMap[hash]
+	for {
+		created, lastMod, cost, waited = false, time.Time{}, 0, false
+		openPath, tmpFile = path, false
+		sh.mu.Lock()
+		op, ok := sh.opMap[hash]
 		switch {
-		case ok && op.opType == 0:
+		case ok && op.opType == opCreate:
 			// concurrently being created
-			c.numHit++
-			c.mu.Unlock()
-			c.logDebugf("Get: File is being created concurrently, waiting for completion...")
+			op.waiters++
+			sh.mu.Unlock()
+			c.logDebug("File is being created concurrently, waiting for completion...", logOp("get"), logHash(hash))
+			waitedAt := time.Now()
 			<-op.done
+			c.waitHist.observe(int64(time.Since(waitedAt)))
 			if op.err != nil {
 				return nil, false, op.err
 			}
-			// file exists, which is just created
+			if op.rejected {
+				// rejected by the admission filter, create again
+				continue
+			}
+			ref = op.ref
+			c.numHit.Add(1)
+			waited = true
+			// file exists, which is just created and referenced for us
 
 		case ok:
 			// concurrently being removed
-			c.mu.Unlock()
-			if isRetry {
+			sh.mu.Unlock()
+			// with EvictReferenced, the file may be removed again while
+			// retrying, as the reference taken does not protect it.
+			if removals++; 1 < removals && !c.evictRefd {
 				return nil, false, fmt.Errorf("%w: removal twice", ErrInternal)
 			}
-			c.logDebugf("Get: File is being deleted concurrently, waiting for completion...")
+			c.logDebug("File is being deleted concurrently, waiting for completion...", logOp("get"), logHash(hash))
 			<-op.done
 			continue
 
 		default:
-			// no concurrent operation
-			if cinfo, err := os.Stat(path); err != nil {
-				if !errors.Is(err, fs.ErrNotExist) {
-					c.numFailed++
-					c.mu.Unlock()
-					return nil, false, fmt.Errorf("internal error, stat failed: %w", err)
-				}
-
-				// file does not exist
-				c.logDebugf("Get: File does not exist, creating...")
-				op = &opEntry{done: make(chan struct{})}
-				c.opMap[hash] = op
-				c.mu.Unlock()
-
-				if err := os.MkdirAll(dir, 0o0700); err != nil {
-					op.err = fmt.Errorf("%s: failed to create: %w", dir, err)
-					_ = os.Remove(path)
-					c.mu.Lock()
-					delete(c.opMap, hash)
-					c.numFailed++
-					c.mu.Unlock()
-					close(op.done)
-
-					return nil, false, op.err
-				}
+			// no concurrent operation, hold the reference while checking
+			// the file so that it is not removed in the meantime.
+			ref = c.refLocked(sh, hash, 1)
+			if ec, ok := sh.costMap[hash]; ok {
+				ec.credit = c.inflationValue() + ec.value()
+				cost = ec.cost
+			}
+			sh.mu.Unlock()
 
-				tmpPath := path + ".tmp"
+			cinfo, err := os.Stat(path)
+			if err == nil {
+				// file exists
+				c.logDebug("Cache exists.", logOp("get"), logHash(hash))
+				lastMod = cinfo.ModTime()
+				c.touch(hash, path)
+				c.numHit.Add(1)
+				break
+			}
+			c.unref(hash, ref)
+			if !errors.Is(err, fs.ErrNotExist) {
+				c.numFailed.Add(1)
+				return nil, false, fmt.Errorf("internal error, stat failed: %w", err)
+			}
 
-				f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o0644)
-				if err != nil {
-					op.err = fmt.Errorf("failed to open file: %w", err)
-					_ = os.Remove(tmpPath)
-					_ = os.Remove(path)
-					c.mu.Lock()
-					delete(c.opMap, hash)
-					c.numFailed++
-					c.mu.Unlock()
-					close(op.done)
-
-					return nil, false, op.err
+			// file does not exist, check again with the lock held to
+			// make sure that it has not been created concurrently.
+			sh.mu.Lock()
+			if _, ok := sh.opMap[hash]; ok {
+				sh.mu.Unlock()
+				continue
+			}
+			if _, err := os.Stat(path); err == nil {
+				sh.mu.Unlock()
+				continue
+			}
+			c.logDebug("File does not exist, creating...", logOp("get"), logHash(hash))
+			op = &opEntry{opType: opCreate, done: make(chan struct{})}
+			c.addOpLocked(sh, hash, op)
+			sh.mu.Unlock()
+
+			if c.sizeHint != nil {
+				hint := c.sizeHint(key)
+				if err := c.reserve(hint); err != nil {
+					return fail(op, err)
 				}
-				if err := c.create(key, f); err != nil {
-					op.err = fmt.Errorf("failed to create file: %w", err)
-					_ = f.Close()
-					_ = os.Remove(tmpPath)
-					_ = os.Remove(path)
-					c.mu.Lock()
-					delete(c.opMap, hash)
-					c.numFailed++
-					c.mu.Unlock()
-					close(op.done)
-
-					return nil, false, op.err
+				reserved = hint
+			}
+			if c.lowDisk() {
+				c.reclaimDisk(0)
+			}
+			res, err := c.createFile(key, dir, path)
+			if err != nil && isNoSpace(err) {
+				c.logWarn("No space left on device, removing cache files to retry...", logOp("get"), logHash(hash), logErr(err))
+				c.reclaimDisk(infounit.ByteCount(c.totalSize.Load()) / enospcReclaimDiv)
+				res, err = c.createFile(key, dir, path)
+			}
+			if err != nil {
+				return fail(op, err)
+			}
+			if res.exists {
+				// created by another process while waiting for the lock
+				c.logDebug("File created by another process.", logOp("get"), logHash(hash))
+				sh.mu.Lock()
+				c.deleteOpLocked(sh, hash)
+				ref = c.refLocked(sh, hash, 1+op.waiters)
+				op.ref = ref
+				sh.mu.Unlock()
+				c.numHit.Add(1)
+				close(op.done)
+				break
+			}
+			cost = res.cost
+			sz := res.size
+
+			sh.mu.Lock()
+			admitted := 0 < op.waiters || c.admitLocked(sh, hash, sz)
+			sh.mu.Unlock()
+			if !admitted {
+				rejPath, err := rejectFile(dir, hash, res.tmpPath)
+				res.unlock()
+				if err != nil {
+					_ = os.Remove(res.tmpPath)
+					return fail(op, err)
 				}
-				_ = f.Close()
 
-				var sz infounit.ByteCount
-				finfo, err := os.Stat(tmpPath)
-				if err != nil {
-					op.err = fmt.Errorf("failed to stat file: %w", err)
-					_ = os.Remove(tmpPath)
-					_ = os.Remove(path)
-					c.mu.Lock()
-					delete(c.opMap, hash)
-					c.numFailed++
-					c.mu.Unlock()
-					close(op.done)
-
-					return nil, false, op.err
+				// file created, but not cached
+				c.logInfo("File successfully created, but not admitted.", logOp("get"), logHash(hash), logKey(key), logSize(sz))
+				sh.mu.Lock()
+				c.deleteOpLocked(sh, hash)
+				sh.tmpRefs[rejPath] = struct{}{}
+				sh.mu.Unlock()
+				c.numRejected.Add(1)
+				op.rejected = true
+				close(op.done)
+				openPath, tmpFile, created = rejPath, true, true
+				break
+			}
+
+			if c.hardLimit {
+				// make room for the file before it is added
+				c.commitMu.Lock()
+				c.makeRoom(sz)
+			}
+			err = os.Rename(res.tmpPath, path)
+			res.unlock()
+			if err != nil {
+				if c.hardLimit {
+					c.commitMu.Unlock()
 				}
-				sz = infounit.ByteCount(finfo.Size())
-
-				if err := os.Rename(tmpPath, path); err != nil {
-					op.err = fmt.Errorf("failed to write file: %w", err)
-					_ = os.Remove(tmpPath)
-					_ = os.Remove(path)
-					c.mu.Lock()
-					delete(c.opMap, hash)
-					c.numFailed++
-					c.mu.Unlock()
-					close(op.done)
-
-					return nil, false, op.err
+				_ = os.Remove(res.tmpPath)
+				return fail(op, fmt.Errorf("failed to write file: %w", err))
+			}
+			if c.durable {
+				if err := syncDir(dir); err != nil {
+					c.logWarn("Failed to sync directory.", logOp("get"), logPath(dir), logErr(err))
 				}
+			}
 
-				// file created
-				c.logPrintf("Get: File successfully created and cached. size=%d", sz)
-				c.mu.Lock()
-				c.numFiles++
-				c.totalSize += sz
-				delete(c.opMap, hash)
-				c.cond.Broadcast()
-				c.numCreated++
-				c.mu.Unlock()
-				close(op.done)
-				created = true
+			// file created, referenced for this and the waiting goroutines
+			c.logInfo("File successfully created and cached.", logOp("get"), logHash(hash), logKey(key), logSize(sz))
+			c.addReservedFile(sz, reserved)
+			reserved = 0
+			if c.hardLimit {
+				c.commitMu.Unlock()
+			}
+			c.numCreated.Add(1)
+			prio := PriorityNormal
+			if c.prioFunc != nil {
+				prio = c.prioFunc(key)
+			}
+			sh.mu.Lock()
+			ec := &entryCost{cost: cost, size: sz}
+			ec.credit = c.inflationValue() + ec.value()
+			sh.costMap[hash] = ec
+			if sh.scanned != nil {
+				sh.scanned[hash] = struct{}{} // not to be counted by the scan
+			}
+			c.addPinnedLocked(sh, hash, sz)
+			c.setPolicyPriorityLocked(sh, hash, prio)
+			c.deleteOpLocked(sh, hash)
+			ref = c.refLocked(sh, hash, 1+op.waiters)
+			op.ref = ref
+			sh.mu.Unlock()
+			close(op.done)
+			c.wakeGC()
+			created = true
+		}
+		unreserve()
+
+		var err error
+		osFile, err = openFile(openPath, c.shared && !tmpFile)
+		switch {
+		case errors.Is(err, errStale) && !tmpFile:
+			// removed concurrently by another process
+			c.logDebug("File removed concurrently by another process, retrying...", logOp("get"), logHash(hash))
+			c.unref(hash, ref)
+			continue
+		case errors.Is(err, fs.ErrNotExist) && c.evictRefd && !tmpFile:
+			// the reference does not protect the file with EvictReferenced,
+			// removed concurrently before opened
+			c.logDebug("File removed concurrently before opened, retrying...", logOp("get"), logHash(hash))
+			c.unref(hash, ref)
+			continue
+		case err != nil:
+			if tmpFile {
+				c.untmp(hash, openPath)
+				_ = os.Remove(openPath)
 			} else {
-				// file exists
-				c.logDebugf("Get: Cache exists.")
-				lastMod = cinfo.ModTime()
-				tnow := time.Now()
-				_ = os.Chtimes(path, tnow, tnow)
-				c.numHit++
-				c.mu.Unlock()
+				c.unref(hash, ref)
 			}
+			return nil, !created, err
 		}
 		break
 	}
 
-	osFile, err := os.Open(path) // O_RDONLY
-	if err != nil {
-		_ = osFile.Close()
-		return nil, !created, fmt.Errorf("failed to open: %w", err)
-	}
 	finfo, err := osFile.Stat()
 	if err != nil {
 		_ = osFile.Close()
+		if tmpFile {
+			c.untmp(hash, openPath)
+			_ = os.Remove(openPath)
+		} else {
+			c.unref(hash, ref)
+		}
 		return nil, !created, fmt.Errorf("failed to stat: %w", err)
 	}
 	if lastMod.IsZero() {
@@ -528,112 +638,181 @@ func (c *Cache[K]) Get(key K) (*File[K], bool, error) {
 		file:    osFile,
 		size:    finfo.Size(),
 		lastMod: lastMod,
+		cost:    cost,
+	}
+	if tmpFile {
+		file.tmpPath = openPath
+	} else {
+		file.ref = ref
+	}
+
+	ev := &Event[K]{
+		Type:    EventHit,
+		Hash:    hash,
+		Key:     key,
+		HasKey:  true,
+		Size:    infounit.ByteCount(finfo.Size()),
+		Elapsed: time.Since(startedAt),
+		Cost:    cost,
+		Waited:  waited,
+	}
+	switch {
+	case tmpFile:
+		ev.Type = EventRejected
+	case created:
+		ev.Type = EventCreated
+	case !waited:
+		c.hitHist.observe(int64(ev.Elapsed))
 	}
-	c.ref(hash)
+	c.emit(ev)
 
 	return file, !created, nil
 }
 
-// opEntry represents the currently processing operation on a cache entry. When
-// accessing an entry, if an another goroutine is processing it, it uses the
-// done channel to wait for that processing to complete.
-type opEntry struct {
-	opType uint8         // 0: creating, 1: removing
-	done   chan struct{} // closed when operation done
-	err    error
+// createResult represents the result of createFile.
+type createResult struct {
+	tmpPath string             // path to the created file
+	size    infounit.ByteCount // size of the created file
+	cost    time.Duration      // time taken by the CreateFunc
+	lock    *fileLock          // cross-process lock, nil if not locked
+	exists  bool               // created by another process instead
 }
 
-// filePath returns the full path of the cache file corresponding to the given
-// hash value.
-func (c *Cache[_]) filePath(hash Hash) (dir, path string) {
-	dir = filepath.Join(c.dir, b2hex(hash[HashSize-1]), b2hex(hash[HashSize-2]))
-	path = filepath.Join(dir, hashHex(hash))
-	return
+// unlock releases the cross-process lock, if held.
+func (r *createResult) unlock() {
+	if r.lock != nil {
+		r.lock.unlock()
+		r.lock = nil
+	}
 }
 
-// Status represents the cache status and statistics.
-type Status struct {
-	NumFiles     uint64             // number of files currently in cache.
-	TotalSize    infounit.ByteCount // total size of files currently in cache.
-	NumRequested uint64             // total number of files requested.
-	NumHit       uint64             // total number of cache hits.
-	NumCreated   uint64             // total number of newly created cache files.
-	NumFailed    uint64             // total number of operation failures.
-	NumRemoved   uint64             // total number of removed cache files.
-	NumOps       int                // number of operations currently being processed.
-	NumRefs      int                // number of currently referenced cache files.
-}
+// createFile creates a new file for the key at path + tmpSuffix using the
+// CreateFunc. It is the caller's responsibility to move the created file to
+// the path or to remove it. If the cross-process create lock is enabled, it
+// holds the lock for the path until the result is unlocked, and reports exists
+// instead if the file was created by another process while waiting for the
+// lock.
+func (c *Cache[K]) createFile(key K, dir, path string) (*createResult, error) {
+	if err := os.MkdirAll(dir, 0o0700); err != nil {
+		return nil, fmt.Errorf("%s: failed to create: %w", dir, err)
+	}
 
-// String returns the string representation of Status.
-func (s Status) String() string {
-	return fmt.Sprintf(
-		"files=%d, size=%.1S, req=%d, hit=%d, new=%d, fail=%d, del=%d, op=%d, ref=%d",
-		s.NumFiles,
-		s.TotalSize,
-		s.NumRequested,
-		s.NumHit,
-		s.NumCreated,
-		s.NumFailed,
-		s.NumRemoved,
-		s.NumOps,
-		s.NumRefs,
-	)
-}
+	res := &createResult{tmpPath: path + tmpSuffix}
+	if c.createLock {
+		lf, err := lockPath(path+lockSuffix, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock: %w", err)
+		}
+		res.lock = lf
+		if _, err := os.Stat(path); err == nil {
+			res.unlock()
+			res.exists = true
+			return res, nil
+		}
+	}
+
+	f, err := os.OpenFile(res.tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o0644)
+	if err != nil {
+		res.unlock()
+		_ = os.Remove(res.tmpPath)
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if !c.beginCreate(f) {
+		_ = f.Close()
+		res.unlock()
+		_ = os.Remove(res.tmpPath)
+		return nil, ErrClosed
+	}
+	createdAt := time.Now()
+	err = c.create(key, f)
+	res.cost = time.Since(createdAt)
+	c.createHist.observe(int64(res.cost))
+	if c.endCreate(f) && err == nil {
+		err = ErrClosed // canceled, the file may be incomplete
+	}
+	if err == nil && c.durable {
+		err = commitFile(f)
+	}
+	_ = f.Close()
+	if err != nil {
+		res.unlock()
+		_ = os.Remove(res.tmpPath)
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
 
-// Status returns the current cache status and statistics.
-func (c *Cache[_]) Status() *Status {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return &Status{
-		NumFiles:     c.numFiles,
-		TotalSize:    c.totalSize,
-		NumRequested: c.numRequested,
-		NumHit:       c.numHit,
-		NumCreated:   c.numCreated,
-		NumFailed:    c.numFailed,
-		NumRemoved:   c.numRemoved,
-		NumOps:       len(c.opMap),
-		NumRefs:      len(c.refMap),
+	finfo, err := os.Stat(res.tmpPath)
+	if err != nil {
+		res.unlock()
+		_ = os.Remove(res.tmpPath)
+		return nil, fmt.Errorf("failed to stat file: %w", err)
 	}
+	res.size = infounit.ByteCount(finfo.Size())
+
+	return res, nil
 }
 
-// logPrefix returns the prefix string for log messages, according to the
-// current configuration.
-func (c *Cache[_]) logPrefix() string {
-	if !c.debugLog {
-		return ""
+// admitLocked reports whether a newly created file of the given size should be
+// cached, according to the admission filter. The file is always admitted
+// while the cache has room for it, or if the entry is pinned. It must be called
+// with sh.mu held.
+func (c *Cache[_]) admitLocked(sh *shard, hash Hash, size infounit.ByteCount) bool {
+	if c.filter == nil {
+		return true
 	}
-	if _, file, line, ok := runtime.Caller(2); ok {
-		return fmt.Sprintf("%s:%d:", filepath.Base(file), line)
+	if _, pinned := sh.pins[hash]; pinned {
+		return true
 	}
-	return "(unknown):"
+	full := c.maxFiles != 0 && c.maxFiles <= c.numFiles.Load() ||
+		c.maxSize != 0 && c.maxSize < c.usedSize()+size
+	if !full {
+		return true
+	}
+	return admissionThreshold <= c.filter.estimate(hash)
 }
 
-// logPrintf outputs a log message according to the current configuration.
-func (c *Cache[_]) logPrintf(format string, v ...any) {
-	if c.log == nil {
-		return
+// admissionThreshold is the minimum estimated number of recent requests for a
+// key required to be admitted into the full cache.
+const admissionThreshold = 2
+
+// rejectFile moves the newly created file at tmpPath, which was not admitted
+// into the cache, to a unique temporary path so that it can be returned to the
+// caller without being cached. It returns the new path.
+func rejectFile(dir string, hash Hash, tmpPath string) (string, error) {
+	f, err := os.CreateTemp(dir, hashHex(hash)+".*"+tmpSuffix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
 	}
-	s := make([]string, 0, 2)
-	if prefix := c.logPrefix(); prefix != "" {
-		s = append(s, prefix)
+	name := f.Name()
+	_ = f.Close()
+	if err := os.Rename(tmpPath, name); err != nil {
+		_ = os.Remove(name)
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
 	}
-	s = append(s, fmt.Sprintf(format, v...))
-
-	c.log.FileCacheLog(strings.Join(s, " "))
+	return name, nil
 }
 
-// logDebugf outputs a debug log message according to the current configuration.
-func (c *Cache[_]) logDebugf(format string, v ...any) {
-	if c.log == nil || !c.debugLog {
-		return
-	}
+// opEntry represents the currently processing operation on a cache entry. When
+// accessing an entry, if an another goroutine is processing it, it uses the
+// done channel to wait for that processing to complete.
+type opEntry struct {
+	opType   uint8         // opCreate or opRemove
+	done     chan struct{} // closed when operation done
+	err      error
+	waiters  int       // number of goroutines waiting for creation
+	rejected bool      // created, but not admitted into the cache
+	ref      *refEntry // references taken for the waiters
+}
 
-	s := make([]string, 0, 2)
-	if prefix := c.logPrefix(); prefix != "" {
-		s = append(s, prefix)
-	}
-	s = append(s, fmt.Sprintf(format, v...))
+// opType values of opEntry.
+const (
+	opCreate uint8 = iota
+	opRemove
+)
 
-	c.log.FileCacheLog(strings.Join(s, " "))
+// filePath returns the full path of the cache file corresponding to the given
+// hash value.
+func (c *Cache[_]) filePath(hash Hash) (dir, path string) {
+	dir = filepath.Join(c.dir, b2hex(hash[HashSize-1]), b2hex(hash[HashSize-2]))
+	path = filepath.Join(dir, hashHex(hash))
+	return
 }
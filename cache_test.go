@@ -0,0 +1,353 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	filecache "github.com/tunabay/go-filecache"
+)
+
+func TestGetAdmission(t *testing.T) {
+	t.Parallel()
+
+	conf := &filecache.Config[filecache.StringKey]{
+		Dir: t.TempDir(),
+		Create: func(_ filecache.StringKey, f *os.File) error {
+			_, err := f.WriteString("data")
+			return err
+		},
+		MaxFiles:  1,
+		Admission: true,
+	}
+	c, err := filecache.NewWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for _, key := range []filecache.StringKey{"a", "b", "a"} {
+			f, _, err := c.Get(key)
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := f.Close(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Get with Admission did not return")
+	}
+}
+
+func TestGetEvictReferenced(t *testing.T) {
+	t.Parallel()
+
+	conf := &filecache.Config[filecache.Uint64Key]{
+		Dir: t.TempDir(),
+		Create: func(_ filecache.Uint64Key, f *os.File) error {
+			_, err := f.WriteString("data")
+			return err
+		},
+		MaxFiles:        4,
+		EvictReferenced: true,
+		AutoServe:       true,
+	}
+	c, err := filecache.NewWithConfig(conf)
+	if errors.Is(err, filecache.ErrInvalidConfig) {
+		t.Skip("EvictReferenced not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = c.Close(context.Background()) }()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := filecache.Uint64Key((i*7 + g) % 12)
+				if i%5 == 0 {
+					_, _ = c.Remove(key)
+				}
+				f, _, err := c.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_ = f.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestGetSingleFlight(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	conf := &filecache.Config[filecache.StringKey]{
+		Dir: t.TempDir(),
+		Create: func(_ filecache.StringKey, f *os.File) error {
+			calls.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			_, err := f.WriteString("data")
+			return err
+		},
+	}
+	c, err := filecache.NewWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = c.Close(context.Background()) }()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, _, err := c.Get("key")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			b, err := io.ReadAll(f)
+			switch {
+			case err != nil:
+				errs <- err
+			case string(b) != "data":
+				errs <- fmt.Errorf("unexpected content: %q", b)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("CreateFunc called %d times, want 1", n)
+	}
+}
+
+func TestGetCreateError(t *testing.T) {
+	t.Parallel()
+
+	errCreate := errors.New("create failed")
+	var calls atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	conf := &filecache.Config[filecache.StringKey]{
+		Dir: t.TempDir(),
+		Create: func(_ filecache.StringKey, _ *os.File) error {
+			if calls.Add(1) == 1 {
+				close(entered)
+				<-release
+			}
+			return errCreate
+		},
+	}
+	c, err := filecache.NewWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = c.Close(context.Background()) }()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	get := func() {
+		defer wg.Done()
+		f, _, err := c.Get("key")
+		if err == nil {
+			_ = f.Close()
+		}
+		errs <- err
+	}
+	wg.Add(1)
+	go get()
+	<-entered
+	for g := 0; g < 7; g++ {
+		wg.Add(1)
+		go get()
+	}
+	time.Sleep(100 * time.Millisecond) // for the waiters to start waiting
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, errCreate) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("CreateFunc called %d times, want 1", n)
+	}
+}
+
+func TestReferencedNotRemoved(t *testing.T) {
+	t.Parallel()
+
+	conf := &filecache.Config[filecache.Uint64Key]{
+		Dir: t.TempDir(),
+		Create: func(key filecache.Uint64Key, f *os.File) error {
+			_, err := f.WriteString(key.String())
+			return err
+		},
+		MaxFiles:   4,
+		GCInterval: time.Millisecond,
+		AutoServe:  true,
+	}
+	c, err := filecache.NewWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = c.Close(context.Background()) }()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := filecache.Uint64Key((i*7 + g) % 16)
+				if i%3 == 0 {
+					if _, err := c.Remove(key); err != nil && !errors.Is(err, filecache.ErrReferenced) {
+						errs <- err
+						return
+					}
+				}
+				if err := checkReferenced(c, key); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// checkReferenced gets the file for the key, and checks that it is neither
+// removed nor replaced while referenced.
+func checkReferenced(c *filecache.Cache[filecache.Uint64Key], key filecache.Uint64Key) error {
+	f, _, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := c.Remove(key); !errors.Is(err, filecache.ErrReferenced) {
+		return fmt.Errorf("%v: Remove of referenced file: %w", key, err)
+	}
+	time.Sleep(time.Millisecond) // for GC to run
+	finfo, err := f.OSFile().Stat()
+	if err != nil {
+		return err
+	}
+	pinfo, err := os.Stat(f.OSFile().Name())
+	if err != nil {
+		return fmt.Errorf("%v: referenced file removed: %w", key, err)
+	}
+	if !os.SameFile(finfo, pinfo) {
+		return fmt.Errorf("%v: referenced file replaced", key)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if string(b) != key.String() {
+		return fmt.Errorf("%v: unexpected content: %q", key, b)
+	}
+	return nil
+}
+
+func TestStatusMatchesCheck(t *testing.T) {
+	t.Parallel()
+
+	conf := &filecache.Config[filecache.Uint64Key]{
+		Dir: t.TempDir(),
+		Create: func(key filecache.Uint64Key, f *os.File) error {
+			_, err := f.Write(make([]byte, 100+int(key)))
+			return err
+		},
+		MaxFiles:   8,
+		GCInterval: time.Millisecond,
+		AutoServe:  true,
+	}
+	c, err := filecache.NewWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = c.Close(context.Background()) }()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := filecache.Uint64Key((i*5 + g) % 32)
+				if i%4 == 0 {
+					if _, err := c.Remove(key); err != nil && !errors.Is(err, filecache.ErrReferenced) {
+						errs <- err
+						return
+					}
+				}
+				f, _, err := c.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_ = f.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	res, err := c.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Errorf("Status does not match Check: %v", res)
+	}
+	if st := c.Status(); st.NumOps != 0 || st.NumRefs != 0 {
+		t.Errorf("operations or references left: ops=%d, refs=%d", st.NumOps, st.NumRefs)
+	}
+}
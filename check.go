@@ -0,0 +1,278 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// CheckResult represents the result of Check. The discrepancies are reported
+// with the paths of the files.
+type CheckResult struct {
+	NumFiles  uint64             // number of cache files found.
+	TotalSize infounit.ByteCount // total size of cache files found.
+
+	CountedFiles uint64             // number of files counted before the check.
+	CountedSize  infounit.ByteCount // total size counted before the check.
+
+	Missing   []string // files created by this Cache, but not found.
+	Extra     []string // unexpected files found in the cache dir.
+	WrongSize []string // files whose size does not match the recorded one.
+	Misplaced []string // cache files found in a wrong directory.
+
+	Repaired bool // whether the discrepancies were repaired.
+}
+
+// OK reports whether no discrepancies were found.
+func (r *CheckResult) OK() bool {
+	return r.NumFiles == r.CountedFiles && r.TotalSize == r.CountedSize &&
+		len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.WrongSize) == 0 && len(r.Misplaced) == 0
+}
+
+// String returns the string representation of CheckResult.
+func (r *CheckResult) String() string {
+	return fmt.Sprintf(
+		"files=%d/%d, size=%.1S/%.1S (found/counted), missing=%d, extra=%d, wrong-size=%d, misplaced=%d, repaired=%v",
+		r.NumFiles,
+		r.CountedFiles,
+		r.TotalSize,
+		r.CountedSize,
+		len(r.Missing),
+		len(r.Extra),
+		len(r.WrongSize),
+		len(r.Misplaced),
+		r.Repaired,
+	)
+}
+
+// Check rescans the cache directory, and corrects the number of files, the
+// total size, the file size histogram and the pinned files counted in memory,
+// which may drift when the files are changed outside of the Cache. It also
+// reports the discrepancies found:
+//
+//   - Missing: the files created by this Cache that no longer exist.
+//   - Extra: the files whose names are not of cache files.
+//   - WrongSize: the files whose size differs from the one recorded when
+//     created by this Cache, or in the extended attribute in durable mode.
+//   - Misplaced: the cache files found in a directory other than the one for
+//     their hash.
+//
+// If repair is true, the missing files are forgotten, the extra files and the
+// files of wrong size are removed, and the misplaced files are moved to where
+// they should be, or removed if the file already exists there. The files of
+// wrong size are not removed while referenced. Check runs exclusively with GC,
+// but not with Get, so the files created or removed while scanning may be
+// miscounted until the next check. With AsyncScan, it waits for the startup
+// scan to complete.
+func (c *Cache[K]) Check(ctx context.Context, repair bool) (*CheckResult, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	select {
+	case <-c.ready:
+	case <-c.closing:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.gcMu.Lock()
+	defer c.gcMu.Unlock()
+
+	res := &CheckResult{
+		CountedFiles: c.numFiles.Load(),
+		CountedSize:  infounit.ByteCount(c.totalSize.Load()),
+		Repaired:     repair,
+	}
+	found := make(map[Hash]infounit.ByteCount)
+	var sizes histogram
+
+	walker := func(path string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case err != nil:
+			c.logWarn("Skip unreadable file.", logOp("check"), logPath(path), logErr(err))
+			return fs.SkipDir
+		case d.IsDir():
+			return nil
+		}
+		fname := d.Name()
+		if strings.HasSuffix(fname, lockSuffix) || strings.HasSuffix(fname, stateSuffix) {
+			return nil
+		}
+		if _, _, ok := parseTmpName(fname); ok {
+			return nil
+		}
+		var hash Hash
+		if len(fname) != HashSize*2 {
+			c.checkExtra(res, path, repair)
+			return nil
+		}
+		if _, err := hex.Decode(hash[:], []byte(fname)); err != nil {
+			c.checkExtra(res, path, repair)
+			return nil
+		}
+		if _, dup := found[hash]; dup {
+			return nil // moved here by repair
+		}
+
+		finfo, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		dir, want := c.filePath(hash)
+		if path != want {
+			res.Misplaced = append(res.Misplaced, path)
+			c.logWarn("Found misplaced cache file.", logOp("check"), logPath(path))
+			if !repair || !c.moveMisplaced(hash, dir, path, want) {
+				return nil
+			}
+			path = want
+		}
+		if c.wrongSize(hash, path, finfo.Size()) {
+			res.WrongSize = append(res.WrongSize, path)
+			c.logWarn("Found cache file of wrong size.", logOp("check"), logPath(path), logSize(infounit.ByteCount(finfo.Size())))
+			if repair {
+				removed, err := c.remove(hash)
+				switch {
+				case err != nil:
+					c.logError("Failed to remove cache file of wrong size.", logOp("check"), logPath(path), logErr(err))
+				case removed != nil:
+					c.emit(&Event[K]{Type: EventRemoved, Hash: hash, Size: infounit.ByteCount(removed.Size())})
+					return nil
+				}
+			}
+		}
+		found[hash] = infounit.ByteCount(finfo.Size())
+		res.NumFiles++
+		res.TotalSize += infounit.ByteCount(finfo.Size())
+		sizes.observe(finfo.Size())
+
+		return nil
+	}
+	if err := filepath.WalkDir(c.dir, walker); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("%s: failed to read cache dir: %w", c.dir, err)
+	}
+
+	var (
+		numPinned  uint64
+		pinnedSize infounit.ByteCount
+	)
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for hash, pe := range sh.pins {
+			pe.size, pe.cached = found[hash]
+			if pe.cached {
+				numPinned++
+				pinnedSize += pe.size
+			}
+		}
+		for hash := range sh.costMap {
+			if _, ok := found[hash]; ok {
+				continue
+			}
+			if _, busy := sh.opMap[hash]; busy {
+				continue
+			}
+			_, path := c.filePath(hash)
+			res.Missing = append(res.Missing, path)
+			if repair {
+				delete(sh.costMap, hash)
+				delete(sh.touched, hash)
+			}
+		}
+		sh.mu.Unlock()
+	}
+	for _, path := range res.Missing {
+		c.logWarn("Cache file missing.", logOp("check"), logPath(path))
+	}
+
+	c.numFiles.Store(res.NumFiles)
+	c.totalSize.Store(uint64(res.TotalSize))
+	c.sizeHist.store(&sizes)
+	c.numPinned.Store(numPinned)
+	c.pinnedSize.Store(uint64(pinnedSize))
+
+	if res.OK() {
+		c.logDebug("Checked.", logOp("check"), slog.Uint64("files", res.NumFiles), logSize(res.TotalSize))
+	} else {
+		c.logWarn("Found discrepancies.", logOp("check"), slog.String("result", res.String()))
+	}
+
+	return res, nil
+}
+
+// checkExtra reports the unexpected file found in the cache directory, and
+// removes it if repair is true.
+func (c *Cache[_]) checkExtra(res *CheckResult, path string, repair bool) {
+	res.Extra = append(res.Extra, path)
+	c.logWarn("Found unexpected file in cache dir.", logOp("check"), logPath(path))
+	if !repair {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.logError("Failed to remove unexpected file.", logOp("check"), logPath(path), logErr(err))
+	}
+}
+
+// wrongSize reports whether the size of the cache file for the hash differs
+// from the one recorded when it was created by this Cache, or in its extended
+// attribute in durable mode.
+func (c *Cache[_]) wrongSize(hash Hash, path string, size int64) bool {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	ec, ok := sh.costMap[hash]
+	sh.mu.Unlock()
+	if ok && ec.size != infounit.ByteCount(size) {
+		return true
+	}
+	if recorded, ok := getSizeAttr(path); ok && c.durable {
+		return recorded != size
+	}
+	return false
+}
+
+// moveMisplaced moves the cache file for the hash found at path to want, where
+// it should be. If the file already exists at want, the misplaced file is
+// removed instead. It reports whether the file was moved.
+func (c *Cache[_]) moveMisplaced(hash Hash, dir, path, want string) bool {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	_, busy := sh.opMap[hash]
+	_, err := os.Stat(want)
+	if busy || err == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.logError("Failed to remove misplaced cache file.", logOp("check"), logPath(path), logErr(err))
+		}
+		return false
+	}
+	if err := os.MkdirAll(dir, 0o0700); err != nil {
+		c.logError("Failed to create directory.", logOp("check"), logPath(dir), logErr(err))
+		return false
+	}
+	if err := os.Rename(path, want); err != nil {
+		c.logError("Failed to move misplaced cache file.", logOp("check"), logPath(path), logErr(err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// Close closes the Cache. After Close is called, Get and Serve fail with
+// ErrClosed. It waits for the in-flight CreateFunc calls to complete, and for
+// Serve to return, including the one started by AutoServe. If the context is
+// done before that, the files being written by the CreateFunc calls are closed
+// so that the writes fail, and the creations are discarded without being
+// cached. Then it writes the access times recorded in memory.
+//
+// It returns the number of File references still outstanding, which are not
+// closed yet. They remain valid and can be closed after Close returns. The
+// error is ctx.Err() if the in-flight operations were canceled, or ErrClosed if
+// the Cache is already closed.
+func (c *Cache[_]) Close(ctx context.Context) (int, error) {
+	c.closeMu.Lock()
+	if c.closed.Load() {
+		c.closeMu.Unlock()
+		return c.numOpenFiles(), ErrClosed
+	}
+	c.closed.Store(true)
+	c.closeMu.Unlock()
+	close(c.closing)
+
+	c.logDebug("Closing...", logOp("close"))
+
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.closeMu.Lock()
+		c.canceled = true
+		for f := range c.creating {
+			_ = f.Close()
+		}
+		n := len(c.creating)
+		c.closeMu.Unlock()
+		c.logWarn("Canceled in-flight creations.", logOp("close"), slog.Int("files", n))
+		err = ctx.Err()
+	}
+
+	c.flushTouches()
+	c.flushPriorities()
+
+	n := c.numOpenFiles()
+	c.logInfo("Closed.", logOp("close"), slog.Int("refs", n))
+
+	return n, err
+}
+
+// begin registers an in-flight operation to be waited for by Close. It returns
+// false if the Cache is closed.
+func (c *Cache[_]) begin() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed.Load() {
+		return false
+	}
+	c.active.Add(1)
+	return true
+}
+
+// beginCreate registers the file being written by CreateFunc, so that it can be
+// closed to cancel the creation by Close. It returns false if the Cache is
+// closed.
+func (c *Cache[_]) beginCreate(f *os.File) bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed.Load() {
+		return false
+	}
+	c.creating[f] = struct{}{}
+	c.active.Add(1)
+	return true
+}
+
+// endCreate unregisters the file registered by beginCreate. It reports whether
+// the creation was canceled by Close.
+func (c *Cache[_]) endCreate(f *os.File) bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	delete(c.creating, f)
+	c.active.Done()
+	return c.canceled
+}
+
+// numOpenFiles returns the number of File objects returned by Get and not
+// closed yet.
+func (c *Cache[_]) numOpenFiles() int {
+	n := int(c.numFileRefs.Load())
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		n += len(sh.tmpRefs)
+		sh.mu.Unlock()
+	}
+	return n
+}
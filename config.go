@@ -5,6 +5,7 @@
 package filecache
 
 import (
+	"log/slog"
 	"time"
 
 	"github.com/tunabay/go-infounit"
@@ -27,38 +28,235 @@ type Config[K Key] struct {
 	// The upper limit on the number of files that can be cached. Zero
 	// value means unlimited. When more than this number of files are
 	// cached, the oldest files will be removed. Note that more than this
-	// number of files may be cached temporarily.
+	// number of files may be cached temporarily, unless HardLimit is set.
 	MaxFiles uint64
 
 	// The limit on the total size of files that can be cached. Zero
 	// value means unlimited. When more than this total size of files are
 	// cached, the oldest files will be removed. Note that more than this
-	// size of files may be cached temporarily. There is no guarantee that
-	// more disk space than this will not be used.
+	// size of files may be cached temporarily, unless HardLimit is set.
+	// There is no guarantee that more disk space than this will not be
+	// used.
 	MaxSize infounit.ByteCount
 
+	// The low watermarks of the number of files and the total size. Once
+	// MaxFiles or MaxSize is exceeded, GC removes files until both fall to
+	// these values, so that it runs less often and removes files in larger
+	// batches. They must not be greater than MaxFiles and MaxSize. Zero
+	// value means the same as MaxFiles and MaxSize respectively.
+	LowFiles uint64
+	LowSize  infounit.ByteCount
+
+	// The minimum free disk space to be kept on the file system containing
+	// the cache directory, in bytes and in percent of the total size. When
+	// the free space falls below either of them, cache files are removed
+	// synchronously before creating a new file, and also by GC, regardless
+	// of MaxFiles and MaxSize. Also when a creation fails because the disk
+	// is full, at least a tenth of the total size of cache files is removed
+	// and the creation is retried once. Zero value means no limit. Only
+	// supported on Linux.
+	MinFreeSpace   infounit.ByteCount
+	MinFreePercent float64
+
+	// If not nil, it is called before creating a new file to get the
+	// expected size of the file for the key. The size is reserved within
+	// MaxSize until the creation completes, and cache files are removed
+	// synchronously to make room for it if needed, so that concurrent
+	// creations do not overshoot MaxSize. Zero return value means unknown,
+	// and nothing is reserved.
+	SizeHint func(K) infounit.ByteCount
+
+	// If true, MaxFiles and MaxSize are enforced strictly. Before a newly
+	// created file is added to the cache, unreferenced cache files are
+	// removed synchronously in Get to make room for it, so that the number
+	// of files and the total size never exceed the limits, except by the
+	// files currently referenced and the pinned files, which are never
+	// removed to make room. Also the reservation by SizeHint must fit
+	// within MaxSize. When enough cache files can not be removed to make
+	// room, Get waits for the other in-flight creations to complete, and
+	// fails with ErrCacheFull if there are none left. Otherwise the size is
+	// reserved beyond MaxSize.
+	HardLimit bool
+
 	// The maximum age of cache files. Note that it is the time since
 	// last access, not the time since creation. Also the cache is not
-	// removed immediately after this age. It is still possible that an
-	// aged cache file will continue to be hit and reused. Zero value
-	// means unlimited.
+	// removed immediately after this age. Expired files are removed by GC,
+	// which is checked to be due every GCInterval regardless of the number
+	// of files and the total size. It is still possible that an aged cache
+	// file will continue to be hit and reused. Zero value means unlimited.
 	MaxAge time.Duration
 
 	// The interval between GC processing to find and remove old cache
-	// files that exceed the configured limits.
+	// files that exceed the configured limits. It is also the interval to
+	// check whether any cache file may have expired. Zero value means one
+	// minute.
 	GCInterval time.Duration
 
+	// The age after which a temporary file left in the cache directory is
+	// removed, such as the one left by a process crashed while creating a
+	// file. Temporary files in use are never removed. They are searched
+	// for at startup and on each GC run. Zero value means one hour.
+	TmpMaxAge time.Duration
+
+	// The interval at which the access times of cache files are written to
+	// the file system. Zero value means that the modification time of the
+	// file is updated on every cache hit. Otherwise, the access times are
+	// tracked in memory and written in batches by Serve, at most once per
+	// file in this interval, before each GC run, and when Serve returns.
+	// This reduces the metadata writes on network or journaling file
+	// systems, at the expense of losing the access times since the last
+	// write on crash.
+	TouchInterval time.Duration
+
+	// The interval at which Serve runs Check to correct the number of
+	// files and the total size counted in memory, which may drift when
+	// the cache files are changed outside of the Cache. The discrepancies
+	// found are only logged and not repaired. Zero value means that Check
+	// is never run periodically.
+	CheckInterval time.Duration
+
+	// If true, newly created files are subject to the TinyLFU-style
+	// admission filter. When the cache is full, a newly created file is
+	// only kept if its key has been requested repeatedly within the
+	// recent requests. Otherwise it is returned to the caller as a
+	// temporary file, which is not cached and is deleted when closed.
+	// This prevents one-time requests from flushing useful cache files.
+	Admission bool
+
+	// The number of recent requests the admission filter keeps track of.
+	// Zero value means the default, which is derived from MaxFiles.
+	AdmissionWindow int
+
+	// The policy to choose the files to be removed when the limits are
+	// exceeded. Zero value means EvictLRU.
+	Eviction EvictionPolicy
+
+	// If true, the cache directory can be shared by multiple processes,
+	// each running its own Cache instance. The processes coordinate with
+	// each other using advisory file locks in the cache directory: a file
+	// is created by only one process at a time, a file opened by a process
+	// is never removed by another, and GC runs in only one process at a
+	// time. The number of files and the total size are recounted on each
+	// GC run, which is also performed every GCInterval. Only supported on
+	// Unix-like systems.
+	Shared bool
+
+	// If true, newly created files are committed to stable storage before
+	// being cached, so that a file served as a hit is never truncated by a
+	// power loss. The file is synced before being renamed to the cache file
+	// path, and the directory is synced after that. Where supported, the
+	// size of the file is also recorded in its extended attribute. At
+	// startup, files whose size does not match the recorded one, and empty
+	// files without the record, are removed as truncated ones.
+	Durable bool
+
+	// If true, a process creating a new file takes an exclusive lock on a
+	// per-file lock file in the cache directory, so that the same file is
+	// not created by multiple processes sharing the cache directory. The
+	// other processes wait for the lock to be released, and then use the
+	// file created. Unlike Shared, each process still accounts only the
+	// files it knows. It is implied by Shared. On Unix-like systems, it
+	// uses advisory file locks, which are released automatically when the
+	// holding process crashes. On the other platforms, the lock file
+	// itself represents the lock, and a lock file left by a crashed
+	// process is detected as stale when it is not refreshed for a minute.
+	CreateLock bool
+
+	// If true, cache files referenced by File objects not closed yet can
+	// also be removed by GC and Remove. The removed file remains readable
+	// through the File until it is closed, and its size is reported as
+	// PendingReclaim in Status until then, as the disk space is not freed.
+	// This prevents long-lived readers from blocking eviction. Only
+	// supported on Unix-like systems, and not with Shared.
+	EvictReferenced bool
+
+	// If true, the files of the entries pinned by Pin are not counted
+	// towards MaxSize and LowSize, so that GC keeps the limits for the
+	// other files. Otherwise, GC may remove all the other files if the
+	// pinned files alone exceed the limits. They are still counted
+	// towards MaxFiles, and reported as TotalSize in Status.
+	ExcludePinnedSize bool
+
+	// If true, NewWithConfig starts a goroutine running Serve in the
+	// background, which is stopped by Close. In this case, Serve must not
+	// be called by the caller.
+	AutoServe bool
+
+	// The number of goroutines walking the cache directory in parallel in
+	// the startup scan and GC. The subdirectories of the cache directory
+	// are distributed to them, which makes the scans much faster on fast
+	// storage or network file systems with large latency. Zero value means
+	// that the cache directory is walked by a single goroutine.
+	ScanConcurrency int
+
+	// If true, NewWithConfig returns without waiting for the startup scan
+	// of the cache directory, which runs in the background instead. Get
+	// can be called during the scan, while the files not scanned yet are
+	// not counted towards the limits, and GC does not run until the scan
+	// completes. The channel returned by Ready is closed on completion,
+	// and the progress is reported in Status. Expired files found by the
+	// scan are left for the first GC run.
+	AsyncScan bool
+
+	// If not nil, it is called with the key of each newly created file to
+	// determine the priority of the entry for eviction, unless set by
+	// SetPriority. GC removes all the eligible files of lower priority
+	// before the ones of higher priority. It is called from the goroutine
+	// calling Get, so it should return quickly. The priorities determined
+	// are persisted in a state file in the cache directory, written before
+	// each GC run and by Close. Without it, the entries are of
+	// PriorityNormal.
+	Priority func(K) Priority
+
+	// If not nil, it is called with each error occurred during GC, such as
+	// a failure to read the cache directory or to remove a file. GC goes on
+	// after the error. It is called from the goroutine running Serve, or
+	// the one calling Get when cache files are removed synchronously.
+	OnGCError func(error)
+
+	// If not nil, it is called for each lifecycle event of cache entries,
+	// such as creation, hit and removal. It is called synchronously from
+	// the goroutine that performed the operation, such as the caller of
+	// Get or the one running Serve, so it should return quickly.
+	OnEvent func(*Event[K])
+
 	// If not nil, Cache outputs log messages to this Logger object.
+	// Ignored if Slog is not nil.
 	Logger Logger
 
+	// If not nil, Cache outputs structured log messages to this
+	// slog.Logger. Each message carries typed attributes such as hash,
+	// key, size, age, op and error. The levels of the messages to be
+	// output are determined by its handler, regardless of DebugLog.
+	Slog *slog.Logger
+
 	// If true, Cache outputs debug log messages. Only effective if
-	// Logger is not nil.
+	// Logger is not nil and Slog is nil.
 	DebugLog bool
 }
 
 // defaultGCInterval defines the default value for Config.GCInterval.
 const defaultGCInterval = time.Minute
 
+// defaultAdmissionWindow defines the minimum default value for
+// Config.AdmissionWindow.
+const defaultAdmissionWindow = 1 << 14
+
+// EvictionPolicy represents the policy to choose the cache files to be removed
+// when the cache exceeds the configured limits.
+type EvictionPolicy uint8
+
+const (
+	// EvictLRU removes the least recently used files first.
+	EvictLRU EvictionPolicy = iota
+
+	// EvictGreedyDual removes the files that are cheap to recreate
+	// relative to their size first, using the GreedyDual-Size algorithm.
+	// The cost of a file is the time taken by the CreateFunc to create it.
+	// Files with the same cost are removed in LRU order.
+	EvictGreedyDual
+)
+
 // Logger is the interface implemented to receive log messages from the running
 // Cache instance.
 type Logger interface {
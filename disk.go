@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"errors"
+	"log/slog"
+	"syscall"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// enospcReclaimDiv determines the minimum size of the cache files removed when
+// a creation fails because the disk is full, which is the total size divided
+// by this value.
+const enospcReclaimDiv = 10
+
+// diskGuard reports whether the free disk space is monitored.
+func (c *Cache[_]) diskGuard() bool {
+	return c.minFree != 0 || c.minFreePct != 0
+}
+
+// lowDisk reports whether the free disk space of the file system containing
+// the cache directory is below MinFreeSpace or MinFreePercent.
+func (c *Cache[_]) lowDisk() bool {
+	if !c.diskGuard() {
+		return false
+	}
+	avail, total, err := diskSpace(c.dir)
+	if err != nil {
+		c.logWarn("Failed to get free disk space.", logPath(c.dir), logErr(err))
+		return false
+	}
+	return avail < uint64(c.minFree) || float64(avail)*100 < c.minFreePct*float64(total)
+}
+
+// reclaimDisk synchronously removes cache files until the free disk space is
+// no longer low, and the total size of the removed files reaches atLeast.
+func (c *Cache[K]) reclaimDisk(atLeast infounit.ByteCount) {
+	n, freed := c.reclaim("reclaim", func(freed infounit.ByteCount) bool {
+		return atLeast <= freed && !c.lowDisk()
+	})
+	if n != 0 {
+		c.logInfo("Removed cache files to free disk space.", logOp("reclaim"), slog.Int("files", n), logSize(freed))
+	}
+}
+
+// isNoSpace reports whether the error is caused by the lack of disk space.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
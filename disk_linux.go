@@ -0,0 +1,24 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build linux
+
+package filecache
+
+import "syscall"
+
+// diskSpaceSupported indicates whether diskSpace is supported on this
+// platform.
+const diskSpaceSupported = true
+
+// diskSpace returns the available and total bytes of the file system
+// containing the path.
+func diskSpace(path string) (avail, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err //nolint:wrapcheck
+	}
+	bsize := uint64(st.Bsize)
+	return st.Bavail * bsize, st.Blocks * bsize, nil
+}
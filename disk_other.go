@@ -0,0 +1,18 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build !linux
+
+package filecache
+
+import "errors"
+
+// diskSpaceSupported indicates whether diskSpace is supported on this
+// platform.
+const diskSpaceSupported = false
+
+// diskSpace is not supported on this platform.
+func diskSpace(string) (avail, total uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"os"
+	"runtime"
+)
+
+// commitFile records the size of the created file and commits its contents to
+// stable storage, before it is renamed to the cache file path.
+func commitFile(f *os.File) error {
+	finfo, err := f.Stat()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	setSizeAttr(f.Name(), finfo.Size())
+
+	return f.Sync() //nolint:wrapcheck
+}
+
+// syncDir commits the entries of the directory to stable storage, so that a
+// file just renamed into the directory survives a power loss. It does nothing
+// on Windows, where directories can not be synced.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	defer d.Close()
+
+	return d.Sync() //nolint:wrapcheck
+}
+
+// isTorn reports whether the cache file at the path of the size seems to be
+// truncated by a power loss. If the size of the file was recorded when it was
+// committed, the actual size is compared with it. Otherwise an empty file is
+// considered as truncated.
+func isTorn(path string, size int64) bool {
+	if recorded, ok := getSizeAttr(path); ok {
+		return recorded != size
+	}
+	return size == 0
+}
@@ -12,3 +12,19 @@ var ErrInvalidConfig = errors.New("invalid config")
 
 // ErrInternal is the error thrown when an internal error occurred.
 var ErrInternal = errors.New("internal error")
+
+// ErrReferenced is the error thrown when the operation can not be performed
+// because the cache file is currently referenced.
+var ErrReferenced = errors.New("referenced")
+
+// ErrClosed is the error thrown when the operation is requested after the Cache
+// has been closed.
+var ErrClosed = errors.New("cache closed")
+
+// ErrInvalidPriority is the error thrown when the priority passed is not one
+// of the defined ones.
+var ErrInvalidPriority = errors.New("invalid priority")
+
+// ErrCacheFull is the error thrown when a new file can not be created because
+// the room for it can not be made within the limits.
+var ErrCacheFull = errors.New("cache full")
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// EventType represents the type of an Event. For removal events, it also
+// represents the reason of the removal.
+type EventType uint8
+
+const (
+	// EventCreated is emitted when a new file is created and cached.
+	EventCreated EventType = iota + 1
+
+	// EventRejected is emitted when a new file is created, but not
+	// admitted into the cache by the admission filter.
+	EventRejected
+
+	// EventHit is emitted when a cached file is requested.
+	EventHit
+
+	// EventEvicted is emitted when a file is removed to keep the number of
+	// files or the total size within the limits.
+	EventEvicted
+
+	// EventExpired is emitted when a file is removed because it was not
+	// accessed for longer than MaxAge.
+	EventExpired
+
+	// EventRemoved is emitted when a file is removed by Cache.Remove.
+	EventRemoved
+)
+
+// String returns the string representation of the EventType.
+func (t EventType) String() string {
+	switch t {
+	case EventCreated:
+		return "created"
+	case EventRejected:
+		return "rejected"
+	case EventHit:
+		return "hit"
+	case EventEvicted:
+		return "evicted"
+	case EventExpired:
+		return "expired"
+	case EventRemoved:
+		return "removed"
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Event represents a lifecycle event of a cache entry. It is passed to the
+// Config.OnEvent callback function.
+type Event[K Key] struct {
+	Type    EventType          // type of the event.
+	Hash    Hash               // hash value of the key.
+	Key     K                  // key, only valid if HasKey is true.
+	HasKey  bool               // false for files found in the cache dir.
+	Size    infounit.ByteCount // size of the file.
+	Time    time.Time          // time when the event occurred.
+	Elapsed time.Duration      // time spent in Get for created and hit.
+	Cost    time.Duration      // time taken by CreateFunc, zero if unknown.
+	Age     time.Duration      // time since last access for removal.
+	Waited  bool               // whether hit waited for concurrent creation.
+}
+
+// emit passes the event to the OnEvent callback function, if configured. It
+// must be called without any shard lock held.
+func (c *Cache[K]) emit(ev *Event[K]) {
+	if c.onEvent == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	c.onEvent(ev)
+}
@@ -59,15 +59,26 @@ func main() {
 		WriteTimeout:   time.Minute,
 		MaxHeaderBytes: 512,
 	}
+	closed := make(chan struct{})
 	go func() {
+		defer close(closed)
 		<-ctx.Done()
 		sdctx, sdcancel := context.WithTimeout(context.Background(), time.Second*5)
 		defer sdcancel()
 		if err := httpd.Shutdown(sdctx); err != nil { //nolint:contextcheck
 			fmt.Fprintf(os.Stderr, "ERROR: httpd: %v\n", err)
 		}
+		// Close the cache after all the requests are completed.
+		if n, err := sv.cache.Close(sdctx); err != nil { //nolint:contextcheck
+			fmt.Fprintf(os.Stderr, "ERROR: cache: %v\n", err)
+		} else if n != 0 {
+			fmt.Fprintf(os.Stderr, "WARN: cache: %d files still open\n", n)
+		}
 	}()
 	if err := httpd.ListenAndServe(); err != nil {
 		fmt.Fprintf(os.Stderr, "httpd: %v\n", err)
 	}
+	if ctx.Err() != nil {
+		<-closed
+	}
 }
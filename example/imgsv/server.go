@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/tunabay/go-filecache"
+	"github.com/tunabay/go-filecache/metrics"
 	"github.com/tunabay/go-infounit"
 )
 
@@ -25,12 +26,15 @@ const cacheDir = "/tmp/go-filecache-example"
 // server represents the example image server. It holds one filecache.Cache
 // instance.
 type server struct {
-	cache *filecache.Cache[*imgParam]
+	cache   *filecache.Cache[*imgParam]
+	metrics *metrics.Collector[*imgParam]
 }
 
 // newServer creates an image server instance.
 func newServer() (*server, error) {
-	sv := &server{}
+	sv := &server{
+		metrics: metrics.NewCollector[*imgParam]("imgsv"),
+	}
 	cacheConf := &filecache.Config[*imgParam]{
 		Dir:        cacheDir,
 		Create:     createImage,
@@ -38,6 +42,7 @@ func newServer() (*server, error) {
 		MaxSize:    infounit.Megabyte * 2,
 		MaxAge:     time.Minute * 10,
 		GCInterval: time.Minute,
+		OnEvent:    sv.metrics.Observe,
 		Logger:     sv,
 		DebugLog:   true,
 	}
@@ -46,6 +51,7 @@ func newServer() (*server, error) {
 		return nil, fmt.Errorf("failed to create cache: %w", err)
 	}
 	sv.cache = cache
+	sv.metrics.SetCache(cache)
 
 	return sv, nil
 }
@@ -111,6 +117,10 @@ func (sv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 
+	case r.URL.Path == "/metrics":
+		sv.metrics.ServeHTTP(w, r)
+		return
+
 	case r.URL.Path == "/image.png":
 	case r.URL.Path == "/favicon.ico":
 
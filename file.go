@@ -18,6 +18,9 @@ type File[K Key] struct {
 	file    *os.File
 	size    int64
 	lastMod time.Time
+	cost    time.Duration
+	tmpPath string    // not empty if the file is not cached
+	ref     *refEntry // references to the cache file
 }
 
 // Name returns the string representation of the associated key.
@@ -38,9 +41,16 @@ func (f *File[_]) Seek(offset int64, whence int) (int64, error) {
 	return f.file.Seek(offset, whence) //nolint:wrapcheck
 }
 
-// Close implements io.Closer interface.
+// Close implements io.Closer interface. If the file was not admitted into the
+// cache, it is deleted.
 func (f *File[_]) Close() error {
-	f.parent.unref(f.hash)
+	if f.tmpPath != "" {
+		err := f.file.Close()
+		f.parent.untmp(f.hash, f.tmpPath)
+		_ = os.Remove(f.tmpPath)
+		return err //nolint:wrapcheck
+	}
+	f.parent.unref(f.hash, f.ref)
 
 	return f.file.Close() //nolint:wrapcheck
 }
@@ -58,6 +68,7 @@ func (f *File[K]) Stat() (os.FileInfo, error) {
 		key:     f.key,
 		size:    f.size,
 		lastMod: f.lastMod,
+		cost:    f.cost,
 	}, nil
 }
 
@@ -66,6 +77,7 @@ type FileInfo[K Key] struct {
 	key     K
 	size    int64
 	lastMod time.Time
+	cost    time.Duration
 }
 
 // Name returns the string representation of the key. Note that it is not the
@@ -81,6 +93,10 @@ func (i *FileInfo[_]) Mode() fs.FileMode { return 0o0400 }
 // ModTime returns the last access time or created time of the cache entry.
 func (i *FileInfo[_]) ModTime() time.Time { return i.lastMod }
 
+// Cost returns the time taken by the CreateFunc to create the file. It returns
+// zero if unknown, such as for files cached before the Cache was created.
+func (i *FileInfo[_]) Cost() time.Duration { return i.cost }
+
 // IsDir always returns false, since a directory can not be cached.
 func (*FileInfo[_]) IsDir() bool { return false }
 
@@ -0,0 +1,624 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/petar/GoLLRB/llrb"
+	"github.com/tunabay/go-infounit"
+)
+
+// Serve serves the Cache instance. It performs find and delete old cache files.
+//
+// It returns when the context is done or the Cache is closed. It returns
+// ErrClosed if the Cache has been closed before it is called. It must not be
+// called if Config.AutoServe is set, as the Cache runs it by itself.
+func (c *Cache[K]) Serve(ctx context.Context) error {
+	if c.autoServe {
+		return fmt.Errorf("%w: Serve called with AutoServe", ErrInvalidConfig)
+	}
+	if !c.begin() {
+		return ErrClosed
+	}
+	c.serve(ctx)
+
+	return nil
+}
+
+// serve runs the GC loop until the context is done or the Cache is closed. The
+// caller must have registered it by c.begin.
+func (c *Cache[K]) serve(ctx context.Context) {
+	defer c.active.Done()
+
+	// periodically wake up in shared mode to catch up with the other
+	// processes.
+	var tick <-chan time.Time
+	if c.shared {
+		ticker := time.NewTicker(c.gcInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// periodically write the access times recorded in memory.
+	var touchTick <-chan time.Time
+	if c.touchIntvl != 0 {
+		ticker := time.NewTicker(c.touchIntvl)
+		defer ticker.Stop()
+		touchTick = ticker.C
+	}
+	defer c.flushTouches()
+	defer c.flushPriorities()
+
+	// periodically check whether any file may have expired, and whether
+	// the free disk space is low.
+	var checkTick <-chan time.Time
+	if c.maxAge != 0 || c.diskGuard() {
+		ticker := time.NewTicker(c.gcInterval)
+		defer ticker.Stop()
+		checkTick = ticker.C
+	}
+
+	// periodically correct the counters drifted by external changes.
+	var reconcileTick <-chan time.Time
+	if c.checkIntvl != 0 {
+		ticker := time.NewTicker(c.checkIntvl)
+		defer ticker.Stop()
+		reconcileTick = ticker.C
+	}
+
+	// GC is disabled until the startup scan completes
+	select {
+	case <-ctx.Done():
+		return
+	case <-c.closing:
+		return
+	case <-c.ready:
+	}
+	due := c.expiryDue() || c.lowDisk()
+
+	for {
+	wait:
+		for !due && !c.overflow() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closing:
+				return
+			case <-c.gcWake:
+			case <-touchTick:
+				c.flushTouches()
+			case <-tick:
+				break wait
+			case <-checkTick:
+				if c.expiryDue() || c.lowDisk() {
+					break wait
+				}
+			case <-reconcileTick:
+				_, err := c.Check(ctx, false)
+				if err != nil && !errors.Is(err, ErrClosed) && ctx.Err() == nil {
+					c.logError("Failed to check.", logOp("check"), logErr(err))
+					c.gcError(err)
+				}
+			}
+		}
+		if c.closed.Load() || ctx.Err() != nil {
+			return
+		}
+		due = false
+
+		var gcLock *fileLock
+		if c.shared {
+			lf, err := lockPath(filepath.Join(c.dir, gcLockName), true)
+			if err != nil {
+				if !isWouldBlock(err) {
+					c.logError("Failed to lock for GC.", logOp("gc"), logErr(err))
+					c.gcError(fmt.Errorf("failed to lock for GC: %w", err))
+				}
+				c.logDebug("GC is running in another process.", logOp("gc"))
+				if !c.waitGC(ctx, touchTick) {
+					return
+				}
+				continue
+			}
+			gcLock = lf
+		}
+
+		c.gcMu.Lock()
+		c.logDebug("Started GC...", logOp("gc"))
+		c.flushTouches() // for the modification times to be up to date
+		c.flushPriorities()
+
+		res, err := c.collect("gc")
+		if err != nil {
+			c.gcMu.Unlock()
+			if gcLock != nil {
+				gcLock.unlock()
+			}
+			if !c.waitGC(ctx, touchTick) {
+				return
+			}
+			continue
+		}
+		if c.shared {
+			// the other processes may have changed the files
+			c.numFiles.Store(res.numFiles)
+			c.totalSize.Store(uint64(res.totalSize))
+		}
+
+		// once the limits are exceeded, remove files down to the low
+		// watermarks.
+		overflow := c.overflow()
+		stop := func(infounit.ByteCount) bool {
+			return c.closed.Load() || !(overflow && c.aboveLow() || c.lowDisk())
+		}
+		cands := res.cands
+		n, _, used := c.evictCands("gc", cands, stop)
+		// collect again if the candidates run out before reaching the low
+		// watermarks, as long as the files are removed.
+		for n != 0 && used == len(cands) && !stop(0) {
+			res, err := c.collect("gc")
+			if err != nil {
+				break
+			}
+			cands = res.cands
+			n, _, used = c.evictCands("gc", cands, stop)
+		}
+		c.cands = cands[used:]
+		c.gcMu.Unlock()
+		if gcLock != nil {
+			gcLock.unlock()
+		}
+		c.logDebug("GC finished.", logOp("gc"))
+
+		if !c.waitGC(ctx, touchTick) {
+			return
+		}
+	}
+}
+
+// scanResult represents the result of collect.
+type scanResult struct {
+	cands     []*candidate       // in the order of eviction
+	numFiles  uint64             // number of cache files found
+	totalSize infounit.ByteCount // total size of cache files found
+}
+
+// collect walks the cache directory to find the candidates for eviction. It
+// also removes the expired cache files and the orphaned temporary files found.
+// The caller must hold c.gcMu. With ScanConcurrency, the subdirectories are
+// walked in parallel, and the files found are merged into the result.
+func (c *Cache[K]) collect(op string) (*scanResult, error) {
+	var maxCands uint64 = 64
+	nf := c.numFiles.Load()
+	for nf+maxCands < c.maxFiles || c.maxFiles != 0 && c.lowFiles+maxCands < nf {
+		maxCands <<= 1
+	}
+	if used := uint64(c.usedSize()); c.maxSize != 0 && uint64(c.lowSize) < used && nf != 0 {
+		// enough to remove the size down to LowSize, by the average size
+		avg := c.totalSize.Load()/nf + 1
+		for maxCands < (used-uint64(c.lowSize))/avg+1 {
+			maxCands <<= 1
+		}
+	}
+	tree := llrb.New()
+
+	res := &scanResult{}
+	var (
+		oldest time.Time
+		mu     sync.Mutex // protects res, oldest and tree with ScanConcurrency
+	)
+	walkStart := time.Now()
+	c.lastCollect = walkStart
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		sh.seen = sh.removes
+		sh.mu.Unlock()
+	}
+	walker := func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			c.logError("Failed to read cache dir.", logOp(op), logPath(path), logErr(err))
+			c.gcError(fmt.Errorf("%s: failed to read: %w", path, err))
+			return fs.SkipDir
+		case d.IsDir():
+			return nil
+		}
+		fname := d.Name()
+		if thash, creating, ok := parseTmpName(fname); ok {
+			finfo, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			removed, sz, err := c.removeOrphanTmp(path, thash, creating, finfo)
+			switch {
+			case err != nil:
+				c.logError("Failed to remove orphaned temporary file.", logOp(op), logPath(path), logErr(err))
+				c.gcError(fmt.Errorf("%s: failed to remove orphaned temporary file: %w", path, err))
+			case removed:
+				c.logInfo("Removed orphaned temporary file.", logOp(op), logPath(path), logSize(sz))
+				c.numTmpRemoved.Add(1)
+			}
+			return nil
+		}
+		if len(fname) != HashSize*2 {
+			return nil
+		}
+		fhashb, err := hex.DecodeString(fname)
+		if err != nil {
+			return nil
+		}
+		var fhash Hash
+		copy(fhash[:], fhashb)
+
+		finfo, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if c.isPinned(fhash) {
+			// neither expired nor evicted
+			mu.Lock()
+			res.numFiles++
+			res.totalSize += infounit.ByteCount(finfo.Size())
+			mu.Unlock()
+			return nil
+		}
+		if age := time.Since(finfo.ModTime()); c.expired(age) {
+			removed, err := c.evictFile(fhash, path, infounit.ByteCount(finfo.Size()), finfo.ModTime(), EventExpired)
+			if err != nil {
+				c.logError("Failed to remove expired cache.", logOp(op), logPath(path), logErr(err))
+				c.gcError(fmt.Errorf("%s: failed to remove expired cache: %w", path, err))
+			}
+			if !removed {
+				// kept while referenced, retried by the next expiry
+				// pass rather than making it due immediately
+				mu.Lock()
+				res.numFiles++
+				res.totalSize += infounit.ByteCount(finfo.Size())
+				mu.Unlock()
+			}
+			return nil
+		}
+		cand := &candidate{
+			hash:    fhash,
+			path:    path,
+			size:    infounit.ByteCount(finfo.Size()),
+			lastMod: finfo.ModTime(),
+		}
+		if c.eviction == EvictGreedyDual {
+			cand.credit = c.credit(fhash)
+		}
+		cand.prio = c.priority(fhash)
+		mu.Lock()
+		defer mu.Unlock()
+		if oldest.IsZero() || finfo.ModTime().Before(oldest) {
+			oldest = finfo.ModTime()
+		}
+		res.numFiles++
+		res.totalSize += infounit.ByteCount(finfo.Size())
+		tree.InsertNoReplace(cand)
+		if maxCands < uint64(tree.Len()) {
+			tree.DeleteMax()
+		}
+		return nil
+	}
+	if err := c.walkCacheDir(walker); err != nil {
+		c.logError("Failed to read cache dir.", logOp(op), logPath(c.dir), logErr(err))
+		c.gcError(fmt.Errorf("%s: failed to read cache dir: %w", c.dir, err))
+		return nil, fmt.Errorf("%s: failed to read cache dir: %w", c.dir, err)
+	}
+	c.setNextExpiry(walkStart, oldest)
+
+	res.cands = make([]*candidate, 0, tree.Len())
+	iterator := func(iif llrb.Item) bool {
+		res.cands = append(res.cands, iif.(*candidate)) //nolint:forcetypeassert
+		return true
+	}
+	tree.AscendGreaterOrEqual(&candidate{prio: PriorityLow}, iterator)
+
+	return res, nil
+}
+
+// evictCands removes the candidates in order until stop reports true for the
+// total size of the files removed so far. It returns the number and the total
+// size of the removed files, and the number of candidates used.
+func (c *Cache[K]) evictCands(op string, cands []*candidate, stop func(infounit.ByteCount) bool) (int, infounit.ByteCount, int) {
+	var (
+		n     int
+		freed infounit.ByteCount
+		used  int
+	)
+	for _, cand := range cands {
+		if stop(freed) {
+			break
+		}
+		used++
+		removed, err := c.evictFile(cand.hash, cand.path, cand.size, cand.lastMod, EventEvicted)
+		if err != nil {
+			c.logError("Failed to remove cache.", logOp(op), logPath(cand.path), logErr(err))
+			c.gcError(fmt.Errorf("%s: failed to remove cache: %w", cand.path, err))
+			continue
+		}
+		if !removed {
+			continue
+		}
+		n++
+		freed += cand.size
+		if c.eviction == EvictGreedyDual {
+			c.raiseInflation(cand.credit)
+		}
+	}
+	return n, freed, used
+}
+
+// reclaim synchronously removes the cache files in the order of eviction,
+// until enough reports true for the total size of the removed files, or no
+// more files can be removed. It first uses the candidates left by the last
+// scan, and then scans the cache directory again if they are not enough,
+// unless the last scan is more recent than GCInterval, in which case GC is
+// woken up instead, not to scan on every call while nothing can be removed.
+// It returns the number and the total size of the removed files. Nothing is
+// removed until the startup scan completes.
+func (c *Cache[K]) reclaim(op string, enough func(infounit.ByteCount) bool) (int, infounit.ByteCount) {
+	if !c.isReady() {
+		return 0, 0 // not to wait for the startup scan
+	}
+	c.gcMu.Lock()
+	defer c.gcMu.Unlock()
+
+	if enough(0) {
+		return 0, 0 // freed by GC while waiting for the lock
+	}
+	n, freed, used := c.evictCands(op, c.cands, enough)
+	c.cands = c.cands[used:]
+	if enough(freed) {
+		return n, freed
+	}
+	if time.Since(c.lastCollect) < c.gcInterval {
+		c.wakeGC()
+		return n, freed
+	}
+
+	res, err := c.collect(op)
+	if err != nil {
+		return n, freed
+	}
+	n2, freed2, used := c.evictCands(op, res.cands, func(f infounit.ByteCount) bool {
+		return enough(freed + f)
+	})
+	c.cands = res.cands[used:]
+
+	return n + n2, freed + freed2
+}
+
+// expired reports whether the cache file last accessed age ago has expired.
+func (c *Cache[_]) expired(age time.Duration) bool {
+	return c.maxAge != 0 && c.maxAge < age
+}
+
+// setNextExpiry sets when the next expiry pass is due, from the oldest
+// modification time of the files found by the scan started at scanStart. The
+// files created after the scan expire later than the ones found by it.
+func (c *Cache[_]) setNextExpiry(scanStart, oldest time.Time) {
+	if c.maxAge == 0 {
+		return
+	}
+	t := scanStart
+	if !oldest.IsZero() && oldest.Before(t) {
+		t = oldest
+	}
+	c.nextExpiry.Store(t.Add(c.maxAge).UnixNano())
+}
+
+// expiryDue reports whether any cache file may have expired since the last
+// scan.
+func (c *Cache[_]) expiryDue() bool {
+	n := c.nextExpiry.Load()
+	return n != 0 && n <= time.Now().UnixNano()
+}
+
+// gcError passes the error occurred during GC to the OnGCError callback
+// function, if configured.
+func (c *Cache[_]) gcError(err error) {
+	if c.onGCError != nil {
+		c.onGCError(err)
+	}
+}
+
+// waitGC waits for the GC interval, while writing the access times on each
+// touchTick. It returns false if the context is done or the Cache is closed
+// before that.
+func (c *Cache[_]) waitGC(ctx context.Context, touchTick <-chan time.Time) bool {
+	timer := time.NewTimer(c.gcInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return false
+		case <-c.closing:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return false
+		case <-touchTick:
+			c.flushTouches()
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// evictFile removes the cache file for the hash found by GC, unless it is
+// referenced without EvictReferenced, being processed, or accessed since
+// lastMod. It reports whether the file is no longer in the cache, including
+// the case where it has been removed outside of the Cache. The event of evType
+// is emitted only if it is removed by evictFile.
+func (c *Cache[K]) evictFile(hash Hash, path string, size infounit.ByteCount, lastMod time.Time, evType EventType) (bool, error) {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	if _, refed := sh.refMap[hash]; refed && !c.evictRefd {
+		sh.mu.Unlock()
+		return false, nil // concurrently read
+	}
+	if _, touched := sh.touched[hash]; touched {
+		sh.mu.Unlock()
+		return false, nil // accessed since the last flush
+	}
+	if _, busy := sh.opMap[hash]; busy {
+		sh.mu.Unlock()
+		return false, nil // concurrently processed
+	}
+	if _, pinned := sh.pins[hash]; pinned {
+		sh.mu.Unlock()
+		return false, nil // pinned since found
+	}
+	op := &opEntry{opType: opRemove, done: make(chan struct{})}
+	c.addOpLocked(sh, hash, op)
+	removed := sh.removes != sh.seen
+	sh.mu.Unlock()
+
+	finfo, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && removed:
+		// possibly removed by Remove since found, already forgotten
+		c.finishOp(hash, op)
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		// removed outside of the Cache, forget it
+		c.logInfo("Cache file removed externally.", logOp("gc"), logPath(path), logSize(size))
+		c.forget(hash, size, op)
+		return true, nil
+	case err != nil:
+		c.finishOp(hash, op)
+		return false, fmt.Errorf("%s: failed to stat: %w", path, err)
+	}
+	if !lastMod.Equal(finfo.ModTime()) {
+		c.finishOp(hash, op)
+		return false, nil // concurrently accessed
+	}
+
+	sz := infounit.ByteCount(finfo.Size())
+	if err := c.unlinkFile(hash, path, sz, op); err != nil {
+		if errors.Is(err, ErrReferenced) {
+			return false, nil // read by another process
+		}
+		return false, err
+	}
+	c.emit(&Event[K]{
+		Type: evType,
+		Hash: hash,
+		Size: sz,
+		Age:  time.Since(lastMod),
+	})
+
+	return true, nil
+}
+
+// unlinkFile removes the cache file for the hash, which is registered as being
+// removed by op, and updates the statistics. It must be called without any
+// shard lock held.
+func (c *Cache[_]) unlinkFile(hash Hash, path string, size infounit.ByteCount, op *opEntry) error {
+	if err := c.removeCacheFile(path); err != nil {
+		c.finishOp(hash, op)
+		return fmt.Errorf("%x: %w", hash[:], err)
+	}
+	c.logInfo("Removed.", logHash(hash), logSize(size)) // successfully removed
+	c.numRemoved.Add(1)
+	c.forget(hash, size, op)
+
+	return nil
+}
+
+// forget discards the states of the cache file for the hash, which no longer
+// exists, and finishes op registered for it. The references to the file are
+// detached as it is still readable through them.
+func (c *Cache[_]) forget(hash Hash, size infounit.ByteCount, op *opEntry) {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	c.deleteOpLocked(sh, hash)
+	c.detachRefLocked(sh, hash, size)
+	delete(sh.costMap, hash)
+	delete(sh.touched, hash)
+	c.subPinnedLocked(sh, hash)
+	c.forgetPriorityLocked(sh, hash)
+	counted := true
+	if sh.scanned != nil {
+		// not counted yet if the startup scan has not reached it
+		_, counted = sh.scanned[hash]
+		delete(sh.scanned, hash)
+	}
+	sh.mu.Unlock()
+	if counted {
+		c.subFile(size)
+	}
+	close(op.done)
+}
+
+// candidate represents a candidate file for deletion in the cache directory.
+// Among these candidates, those with the lowest priority, then the lowest
+// credit, and then the oldest lastMod will be deleted in order. The credit is
+// always zero with EvictLRU.
+type candidate struct {
+	hash    Hash
+	path    string
+	size    infounit.ByteCount
+	lastMod time.Time
+	credit  float64
+	prio    Priority
+}
+
+// Less compares the prio, credit and lastMod values of the two candidates and
+// reports the result.
+func (c *candidate) Less(xif llrb.Item) bool {
+	x := xif.(*candidate) //nolint:forcetypeassert
+	if c.prio != x.prio {
+		return c.prio < x.prio
+	}
+	if c.credit != x.credit {
+		return c.credit < x.credit
+	}
+	return c.lastMod.Before(x.lastMod)
+}
+
+// entryCost represents the measured creation cost of a cache file created by
+// this Cache instance.
+type entryCost struct {
+	cost   time.Duration      // time taken by the CreateFunc
+	size   infounit.ByteCount // size of the created file
+	credit float64            // GreedyDual-Size H value
+}
+
+// value returns the cost per byte of the entry.
+func (e *entryCost) value() float64 {
+	size := float64(e.size)
+	if size < 1 {
+		size = 1
+	}
+	return float64(e.cost) / size
+}
+
+// credit returns the GreedyDual-Size H value of the cache file for the hash.
+// Files whose creation cost is unknown, such as those found at startup, are
+// treated as the cheapest ones to recreate.
+func (c *Cache[_]) credit(hash Hash) float64 {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if e, ok := sh.costMap[hash]; ok {
+		return e.credit
+	}
+	return c.inflationValue()
+}
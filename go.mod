@@ -1,6 +1,6 @@
 module github.com/tunabay/go-filecache
 
-go 1.19
+go 1.21
 
 require (
 	github.com/petar/GoLLRB v0.0.0-20210522233825-ae3b015fd3e9
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// Histogram represents a snapshot of the distribution of values, such as
+// latencies in nanoseconds or file sizes in bytes. The values are counted in
+// logarithmic buckets, each power of two range being divided into four, so
+// that percentiles can be estimated with an error of at most 25%.
+type Histogram struct {
+	counts [histNumBuckets]uint64
+	count  uint64
+	sum    int64
+}
+
+const (
+	histSubBits    = 2
+	histSub        = 1 << histSubBits
+	histNumBuckets = (64-histSubBits)*histSub + histSub
+)
+
+// Count returns the number of values in the histogram.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	return h.count
+}
+
+// Sum returns the sum of the values in the histogram.
+func (h *Histogram) Sum() int64 {
+	if h == nil {
+		return 0
+	}
+	return h.sum
+}
+
+// Mean returns the mean of the values in the histogram, or zero if empty.
+func (h *Histogram) Mean() float64 {
+	if h == nil || h.count == 0 {
+		return 0
+	}
+	return float64(h.sum) / float64(h.count)
+}
+
+// Percentile returns the estimated p-th percentile of the values in the
+// histogram, where p is in the range 0 to 100. It returns zero if empty.
+func (h *Histogram) Percentile(p float64) int64 {
+	if h == nil || h.count == 0 {
+		return 0
+	}
+	switch {
+	case p < 0:
+		p = 0
+	case 100 < p:
+		p = 100
+	}
+	rank := p / 100 * float64(h.count)
+	var cum float64
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		if rank <= cum+float64(n) {
+			lo, hi := histBounds(i)
+			frac := (rank - cum) / float64(n)
+			return lo + int64(frac*float64(hi-lo))
+		}
+		cum += float64(n)
+	}
+	_, hi := histBounds(histNumBuckets - 1)
+	return hi
+}
+
+// histIndex returns the index of the bucket for the value.
+func histIndex(v int64) int {
+	if v < histSub {
+		if v < 0 {
+			return 0
+		}
+		return int(v)
+	}
+	n := bits.Len64(uint64(v))
+	m := int(uint64(v) >> (n - histSubBits - 1))
+	return (n-histSubBits)*histSub + m - histSub
+}
+
+// histBounds returns the range of the values counted in the bucket i, where lo
+// is inclusive and hi is exclusive.
+func histBounds(i int) (lo, hi int64) {
+	if i < histSub {
+		return int64(i), int64(i) + 1
+	}
+	n := i/histSub + histSubBits
+	m := int64(i%histSub + histSub)
+	sh := n - histSubBits - 1
+	lo = m << sh
+	if hi = (m + 1) << sh; hi <= 0 {
+		hi = 1<<63 - 1 // overflow for the last bucket
+	}
+	return lo, hi
+}
+
+// histogram is the concurrency-safe histogram to record the values. It can be
+// updated without locks.
+type histogram struct {
+	counts [histNumBuckets]atomic.Uint64
+	sum    atomic.Int64
+}
+
+// observe adds the value to the histogram.
+func (h *histogram) observe(v int64) {
+	h.counts[histIndex(v)].Add(1)
+	h.sum.Add(v)
+}
+
+// forget removes the value added previously from the histogram.
+func (h *histogram) forget(v int64) {
+	h.counts[histIndex(v)].Add(^uint64(0))
+	h.sum.Add(-v)
+}
+
+// store replaces the values of the histogram with the ones of src.
+func (h *histogram) store(src *histogram) {
+	for i := range h.counts {
+		h.counts[i].Store(src.counts[i].Load())
+	}
+	h.sum.Store(src.sum.Load())
+}
+
+// snapshot returns the snapshot of the histogram.
+func (h *histogram) snapshot() *Histogram {
+	s := &Histogram{sum: h.sum.Load()}
+	for i := range h.counts {
+		s.counts[i] = h.counts[i].Load()
+		s.count += s.counts[i]
+	}
+	return s
+}
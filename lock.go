@@ -0,0 +1,144 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// lockSuffix is the suffix of the lock files in the cache directory.
+const lockSuffix = ".lock"
+
+// gcLockName is the name of the lock file to run GC exclusively among the
+// processes sharing the cache directory.
+const gcLockName = ".gc" + lockSuffix
+
+// staleLockAge is the age of the lock file created by createLock after which
+// it is considered to be left by a crashed process.
+const staleLockAge = time.Minute
+
+// takeoverSuffix is appended to the path of the lock file to name the file
+// held while taking over the stale lock.
+const takeoverSuffix = ".takeover" + lockSuffix
+
+// errStale is the internal error indicating that the cache file was removed or
+// replaced by another process before it was locked.
+var errStale = errors.New("stale file")
+
+// fileLock represents a cross-process lock held on a lock file.
+type fileLock struct {
+	file *os.File
+	stop chan struct{} // stops refreshing the lock file, nil if not used
+}
+
+// unlock removes the lock file and releases the lock.
+func (l *fileLock) unlock() {
+	if l.stop != nil {
+		// the lock file itself is the lock, remove after closing
+		close(l.stop)
+		_ = l.file.Close()
+		_ = os.Remove(l.file.Name())
+		return
+	}
+	// remove while holding the lock, see lockPath
+	_ = os.Remove(l.file.Name())
+	_ = l.file.Close()
+}
+
+// openFile opens the cache file at the path for reading. If lease is true, a
+// shared lock is placed on the file so that the other processes do not remove
+// it while it is open. It returns errStale if the file was removed or replaced
+// by another process before the lock was obtained.
+func openFile(path string, lease bool) (*os.File, error) {
+	f, err := os.Open(path) // O_RDONLY
+	if err != nil {
+		if lease && errors.Is(err, fs.ErrNotExist) {
+			return nil, errStale
+		}
+		return nil, fmt.Errorf("failed to open: %w", err)
+	}
+	if !lease {
+		return f, nil
+	}
+	if err := flock(f, lockSH); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to lock: %w", err)
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to stat: %w", err)
+	}
+	if pinfo, err := os.Stat(path); err != nil || !os.SameFile(finfo, pinfo) {
+		_ = f.Close()
+		return nil, errStale
+	}
+	return f, nil
+}
+
+// removeCacheFile removes the cache file at the path. In shared mode, it fails
+// with ErrReferenced if the file is currently open by another process.
+func (c *Cache[_]) removeCacheFile(path string) error {
+	if !c.shared {
+		return os.Remove(path) //nolint:wrapcheck
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	defer f.Close()
+	if err := flock(f, lockEX|lockNB); err != nil {
+		if isWouldBlock(err) {
+			return ErrReferenced
+		}
+		return err
+	}
+	return os.Remove(path) //nolint:wrapcheck
+}
+
+// createLock creates the lock file at the path exclusively, where the existence
+// of the file itself represents the lock. It returns an error satisfying
+// fs.ErrExist if the lock is held by another. The lock file not refreshed for
+// longer than staleLockAge is taken over as left by a crashed process. Only
+// the one who exclusively created the takeover file removes the stale lock
+// file, after checking it is still stale, so that two waiters never remove the
+// lock just created by either of them.
+func createLock(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o0600)
+		if !errors.Is(err, fs.ErrExist) || !isStaleLock(path) {
+			return f, err //nolint:wrapcheck
+		}
+		takeover := path + takeoverSuffix
+		tf, terr := os.OpenFile(takeover, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o0600)
+		if terr != nil {
+			if errors.Is(terr, fs.ErrExist) && isStaleLock(takeover) {
+				// left by a process crashed while taking over
+				_ = os.Remove(takeover)
+			}
+			return nil, err //nolint:wrapcheck
+		}
+		stale := isStaleLock(path)
+		if stale {
+			_ = os.Remove(path)
+		}
+		_ = tf.Close()
+		_ = os.Remove(takeover)
+		if !stale {
+			return nil, err //nolint:wrapcheck
+		}
+	}
+}
+
+// isStaleLock reports whether the lock file at the path exists, and has not
+// been refreshed for longer than staleLockAge.
+func isStaleLock(path string) bool {
+	finfo, err := os.Stat(path)
+	return err == nil && staleLockAge < time.Since(finfo.ModTime())
+}
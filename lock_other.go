@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// lockSupported indicates whether the advisory file locks are supported.
+const lockSupported = false
+
+// unlinkOpenSupported indicates whether a file can be removed while it is open,
+// remaining readable through the open file descriptor.
+const unlinkOpenSupported = false
+
+const (
+	lockSH = 1 << iota
+	lockEX
+	lockNB
+)
+
+// errWouldBlock is the error returned by lockPath when the lock is held by
+// another and nonblock is specified.
+var errWouldBlock = errors.New("lock held by another")
+
+const (
+	// lockRefreshInterval is the interval to refresh the modification time
+	// of the lock file while it is held.
+	lockRefreshInterval = staleLockAge / 4
+
+	// lockMinBackoff and lockMaxBackoff are the range of the interval to
+	// poll the lock file while it is held by another.
+	lockMinBackoff = time.Millisecond * 10
+	lockMaxBackoff = time.Second
+)
+
+// lockPath creates the lock file at the path exclusively by createLock. Since
+// advisory locks are not available on this platform, the existence of the lock
+// file itself represents the lock. While the lock file exists, it polls with
+// backoff, or fails with errWouldBlock if nonblock is true. The holder keeps
+// refreshing the modification time of the lock file, and the one not refreshed
+// for longer than staleLockAge is taken over as a stale lock left by a crashed
+// process.
+func lockPath(path string, nonblock bool) (*fileLock, error) {
+	backoff := lockMinBackoff
+	for {
+		f, err := createLock(path)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			l := &fileLock{file: f, stop: make(chan struct{})}
+			go refreshLock(path, l.stop)
+			return l, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err //nolint:wrapcheck
+		}
+		if nonblock {
+			return nil, errWouldBlock
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; lockMaxBackoff < backoff {
+			backoff = lockMaxBackoff
+		}
+	}
+}
+
+// refreshLock refreshes the modification time of the lock file periodically
+// until stop is closed.
+func refreshLock(path string, stop chan struct{}) {
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			tnow := time.Now()
+			_ = os.Chtimes(path, tnow, tnow)
+		}
+	}
+}
+
+// flock is not supported on this platform.
+func flock(*os.File, int) error { return errors.ErrUnsupported }
+
+// isWouldBlock reports whether the error indicates that the lock is held by
+// another.
+func isWouldBlock(err error) bool { return errors.Is(err, errWouldBlock) }
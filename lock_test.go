@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCreateLockStale(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for i := 0; i < 200; i++ {
+		path := filepath.Join(dir, strconv.Itoa(i)+lockSuffix)
+		if err := os.WriteFile(path, nil, 0o0600); err != nil {
+			t.Fatal(err)
+		}
+		stale := time.Now().Add(-2 * staleLockAge)
+		if err := os.Chtimes(path, stale, stale); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg       sync.WaitGroup
+			acquired atomic.Int32
+		)
+		start := make(chan struct{})
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				f, err := createLock(path)
+				switch {
+				case err == nil:
+					acquired.Add(1)
+					_ = f.Close()
+				case !errors.Is(err, fs.ErrExist):
+					t.Error(err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if n := acquired.Load(); n != 1 {
+			t.Fatalf("stale lock acquired by %d, want 1", n)
+		}
+		if _, err := os.Stat(path + takeoverSuffix); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("takeover file left: %v", err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package filecache
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockSupported indicates whether the advisory file locks are supported.
+const lockSupported = true
+
+// unlinkOpenSupported indicates whether a file can be removed while it is open,
+// remaining readable through the open file descriptor.
+const unlinkOpenSupported = true
+
+const (
+	lockSH = syscall.LOCK_SH
+	lockEX = syscall.LOCK_EX
+	lockNB = syscall.LOCK_NB
+)
+
+// lockPath opens or creates the lock file at the path and locks it exclusively
+// using flock. If nonblock is true and the lock is held by another, it fails
+// immediately with an error for which isWouldBlock reports true. Otherwise it
+// waits until the lock is released. Since a lock held by a crashed process is
+// released by the kernel, a lock file left behind is simply reused. Since the
+// previous holder removes the lock file when releasing it, it retries until the
+// locked file is the one actually at the path.
+func lockPath(path string, nonblock bool) (*fileLock, error) {
+	how := lockEX
+	if nonblock {
+		how |= lockNB
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o0600)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		if err := flock(f, how); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		finfo, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err //nolint:wrapcheck
+		}
+		if pinfo, err := os.Stat(path); err == nil && os.SameFile(finfo, pinfo) {
+			return &fileLock{file: f}, nil
+		}
+		_ = f.Close() // removed by the previous holder, retry
+	}
+}
+
+// flock applies an advisory lock on the open file. The lock is released when
+// the file is closed.
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err //nolint:wrapcheck
+		}
+	}
+}
+
+// isWouldBlock reports whether the error indicates that the lock is held by
+// another.
+func isWouldBlock(err error) bool {
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
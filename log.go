@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// logAttrs outputs a log message with the attributes according to the current
+// configuration. If the slog.Logger is configured, the message is passed to it
+// as a structured record. Otherwise the attributes are formatted into a line
+// and passed to the Logger.
+func (c *Cache[_]) logAttrs(level slog.Level, msg string, attrs ...slog.Attr) {
+	switch {
+	case c.slog != nil:
+		ctx := context.Background()
+		if !c.slog.Enabled(ctx, level) {
+			return
+		}
+		var pcs [1]uintptr
+		runtime.Callers(3, pcs[:]) // skip Callers, logAttrs and the wrapper
+		r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+		r.AddAttrs(attrs...)
+		_ = c.slog.Handler().Handle(ctx, r)
+
+	case c.log != nil:
+		if level < slog.LevelInfo && !c.debugLog {
+			return
+		}
+		var b strings.Builder
+		if c.debugLog {
+			if _, file, line, ok := runtime.Caller(2); ok {
+				fmt.Fprintf(&b, "%s:%d: ", filepath.Base(file), line)
+			} else {
+				b.WriteString("(unknown): ")
+			}
+		}
+		if slog.LevelInfo < level {
+			b.WriteString(level.String())
+			b.WriteString(": ")
+		}
+		b.WriteString(msg)
+		for _, a := range attrs {
+			v := a.Value.String()
+			if v == "" || strings.ContainsAny(v, " \"=") {
+				v = strconv.Quote(v)
+			}
+			b.WriteString(" ")
+			b.WriteString(a.Key)
+			b.WriteString("=")
+			b.WriteString(v)
+		}
+		c.log.FileCacheLog(b.String())
+	}
+}
+
+// logDebug outputs a debug log message.
+func (c *Cache[_]) logDebug(msg string, attrs ...slog.Attr) {
+	c.logAttrs(slog.LevelDebug, msg, attrs...)
+}
+
+// logInfo outputs an informational log message.
+func (c *Cache[_]) logInfo(msg string, attrs ...slog.Attr) {
+	c.logAttrs(slog.LevelInfo, msg, attrs...)
+}
+
+// logWarn outputs a warning log message.
+func (c *Cache[_]) logWarn(msg string, attrs ...slog.Attr) {
+	c.logAttrs(slog.LevelWarn, msg, attrs...)
+}
+
+// logError outputs an error log message.
+func (c *Cache[_]) logError(msg string, attrs ...slog.Attr) {
+	c.logAttrs(slog.LevelError, msg, attrs...)
+}
+
+// The following functions create the log attributes commonly used, so that the
+// same keys and value types are always used for the same kind of values.
+
+func logOp(op string) slog.Attr          { return slog.String("op", op) }
+func logHash(hash Hash) slog.Attr        { return slog.String("hash", hashHex(hash)) }
+func logKey(key fmt.Stringer) slog.Attr  { return slog.String("key", key.String()) }
+func logPath(path string) slog.Attr      { return slog.String("path", path) }
+func logAge(age time.Duration) slog.Attr { return slog.Duration("age", age) }
+func logErr(err error) slog.Attr         { return slog.Any("error", err) }
+func logSize(sz infounit.ByteCount) slog.Attr {
+	return slog.Uint64("size", uint64(sz))
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+/*
+Package metrics provides a collector that exports the statistics of a
+filecache.Cache in the Prometheus text exposition format, without depending on
+the Prometheus client library.
+
+The Collector receives cache events through the Config.OnEvent callback to
+build latency histograms and removal counters, and reads the current Status of
+the Cache on each scrape:
+
+	col := metrics.NewCollector[MyKey]("myapp")
+	conf.OnEvent = col.Observe
+	cache, err := filecache.NewWithConfig(conf)
+	...
+	col.SetCache(cache)
+	http.Handle("/metrics", col)
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tunabay/go-filecache"
+)
+
+// Collector collects the statistics of a filecache.Cache and writes them in
+// the Prometheus text exposition format.
+type Collector[K filecache.Key] struct {
+	prefix string
+	cache  *filecache.Cache[K]
+
+	getHit   *histogram
+	getMiss  *histogram
+	getWait  *histogram
+	create   *histogram
+	removals map[filecache.EventType]uint64
+
+	mu sync.Mutex
+}
+
+// NewCollector creates a Collector. The metric names are prefixed with the
+// namespace followed by "_filecache_", or only "filecache_" if the namespace
+// is empty.
+func NewCollector[K filecache.Key](namespace string) *Collector[K] {
+	prefix := "filecache_"
+	if namespace != "" {
+		prefix = namespace + "_" + prefix
+	}
+	return &Collector[K]{
+		prefix:   prefix,
+		getHit:   newHistogram(),
+		getMiss:  newHistogram(),
+		getWait:  newHistogram(),
+		create:   newHistogram(),
+		removals: make(map[filecache.EventType]uint64),
+	}
+}
+
+// SetCache sets the Cache to read the Status from. The metrics derived from the
+// Status are not written until this is called.
+func (col *Collector[K]) SetCache(cache *filecache.Cache[K]) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	col.cache = cache
+}
+
+// Observe records the cache event. It is intended to be set to
+// filecache.Config.OnEvent, or called from it.
+func (col *Collector[K]) Observe(ev *filecache.Event[K]) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	switch ev.Type {
+	case filecache.EventHit:
+		if ev.Waited {
+			col.getWait.observe(ev.Elapsed)
+		} else {
+			col.getHit.observe(ev.Elapsed)
+		}
+	case filecache.EventCreated, filecache.EventRejected:
+		col.getMiss.observe(ev.Elapsed)
+		col.create.observe(ev.Cost)
+	case filecache.EventEvicted, filecache.EventExpired, filecache.EventRemoved:
+		col.removals[ev.Type]++
+	}
+}
+
+// ServeHTTP implements http.Handler to serve the metrics.
+func (col *Collector[K]) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = col.WriteTo(w)
+}
+
+// WriteTo writes all the metrics to w in the Prometheus text exposition format.
+// It implements io.WriterTo interface.
+func (col *Collector[K]) WriteTo(w io.Writer) (int64, error) {
+	col.mu.Lock()
+	cache := col.cache
+	col.mu.Unlock()
+
+	var st *filecache.Status
+	if cache != nil {
+		st = cache.Status()
+	}
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	ew := &expWriter{w: bufio.NewWriter(w), prefix: col.prefix}
+	if st != nil {
+		ew.metric("files", "gauge", "Number of files currently in cache.", float64(st.NumFiles))
+		ew.metric("size_bytes", "gauge", "Total size of files currently in cache.", float64(st.TotalSize))
+		ew.metric("pinned_files", "gauge", "Number of pinned files currently in cache.", float64(st.NumPinned))
+		ew.metric("pinned_bytes", "gauge", "Total size of pinned files currently in cache.", float64(st.PinnedSize))
+		ew.metric("pending_reclaim_bytes", "gauge", "Total size of removed files still referenced.", float64(st.PendingReclaim))
+		ready := 0.0
+		if st.Ready {
+			ready = 1
+		}
+		ew.metric("ready", "gauge", "Whether the startup scan has completed.", ready)
+		ew.metric("scanned_files", "gauge", "Number of cache files found by the startup scan so far.", float64(st.NumScanned))
+		ew.metric("requests_total", "counter", "Total number of files requested.", float64(st.NumRequested))
+		ew.metric("hits_total", "counter", "Total number of cache hits.", float64(st.NumHit))
+		ew.metric("created_total", "counter", "Total number of newly created cache files.", float64(st.NumCreated))
+		ew.metric("failed_total", "counter", "Total number of operation failures.", float64(st.NumFailed))
+		ew.metric("removed_total", "counter", "Total number of removed cache files.", float64(st.NumRemoved))
+		ew.metric("rejected_total", "counter", "Total number of created files not admitted.", float64(st.NumRejected))
+		ew.metric("tmp_removed_total", "counter", "Total number of removed orphaned temporary files.", float64(st.NumTmpRemoved))
+		ew.metric("operations", "gauge", "Number of operations currently being processed.", float64(st.NumOps))
+		ew.metric("references", "gauge", "Number of currently referenced cache files.", float64(st.NumRefs))
+	}
+
+	ew.header("removals_total", "counter", "Total number of removed cache files by reason.")
+	for _, t := range []filecache.EventType{filecache.EventEvicted, filecache.EventExpired, filecache.EventRemoved} {
+		ew.sample("removals_total", `reason="`+t.String()+`"`, float64(col.removals[t]))
+	}
+
+	ew.header("get_duration_seconds", "histogram", "Latency of Get by result.")
+	col.getHit.write(ew, "get_duration_seconds", `result="hit"`)
+	col.getMiss.write(ew, "get_duration_seconds", `result="miss"`)
+	col.getWait.write(ew, "get_duration_seconds", `result="wait"`)
+
+	ew.header("create_duration_seconds", "histogram", "Time taken by CreateFunc.")
+	col.create.write(ew, "create_duration_seconds", "")
+
+	if ew.err == nil {
+		ew.err = ew.w.Flush()
+	}
+
+	return ew.n, ew.err
+}
+
+// defaultBuckets is the upper bounds in seconds of the histogram buckets.
+var defaultBuckets = []float64{
+	.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05,
+	.1, .25, .5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// histogram represents a cumulative histogram of durations.
+type histogram struct {
+	counts []uint64 // for each of defaultBuckets, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+// newHistogram creates an empty histogram.
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(defaultBuckets))}
+}
+
+// observe adds the duration to the histogram.
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	if i := sort.SearchFloat64s(defaultBuckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes the samples of the histogram.
+func (h *histogram) write(ew *expWriter, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cum uint64
+	for i, le := range defaultBuckets {
+		cum += h.counts[i]
+		ew.sample(name+"_bucket", labels+sep+`le="`+formatFloat(le)+`"`, float64(cum))
+	}
+	ew.sample(name+"_bucket", labels+sep+`le="+Inf"`, float64(h.count))
+	ew.sample(name+"_sum", labels, h.sum)
+	ew.sample(name+"_count", labels, float64(h.count))
+}
+
+// expWriter writes the text exposition format, keeping the first error.
+type expWriter struct {
+	w      *bufio.Writer
+	prefix string
+	n      int64
+	err    error
+}
+
+// printf writes the formatted string unless an error has occurred.
+func (ew *expWriter) printf(format string, v ...any) {
+	if ew.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(ew.w, format, v...)
+	ew.n += int64(n)
+	ew.err = err
+}
+
+// header writes the HELP and TYPE lines of the metric.
+func (ew *expWriter) header(name, typ, help string) {
+	ew.printf("# HELP %s%s %s\n", ew.prefix, name, help)
+	ew.printf("# TYPE %s%s %s\n", ew.prefix, name, typ)
+}
+
+// sample writes a sample line of the metric.
+func (ew *expWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	ew.printf("%s%s%s %s\n", ew.prefix, name, labels, formatFloat(v))
+}
+
+// metric writes a metric with a single sample without labels.
+func (ew *expWriter) metric(name, typ, help string, v float64) {
+	ew.header(name, typ, help)
+	ew.sample(name, "", v)
+}
+
+// formatFloat returns the string representation of the sample value.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// pinStateName is the name of the state file persisting the pinned entries.
+const pinStateName = ".pins" + stateSuffix
+
+// pinEntry represents a pinned cache entry.
+type pinEntry struct {
+	size   infounit.ByteCount // size of the file, if cached
+	cached bool               // whether the file is counted as cached
+}
+
+// Pin pins the cache entry for the key, so that its file is never removed by
+// GC, neither to keep the limits nor for MaxAge. The key may be pinned before
+// the file is created. The pinned entries are persisted in a state file in the
+// cache directory, and restored at startup. With Shared, the pins made by the
+// other processes after startup are not known. Remove still removes the file
+// of a pinned entry, while the entry remains pinned. If the state file can not
+// be written, it returns the error, while the pin takes effect in memory.
+func (c *Cache[K]) Pin(key K) error {
+	return c.setPin(key.Hash(), true)
+}
+
+// Unpin unpins the cache entry for the key pinned by Pin, so that its file can
+// be removed by GC again. It does nothing if the entry is not pinned.
+func (c *Cache[K]) Unpin(key K) error {
+	return c.setPin(key.Hash(), false)
+}
+
+// Pinned reports whether the cache entry for the key is pinned.
+func (c *Cache[K]) Pinned(key K) bool {
+	return c.isPinned(key.Hash())
+}
+
+// setPin pins or unpins the entry for the hash, and writes the state file.
+func (c *Cache[_]) setPin(hash Hash, pin bool) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+
+	c.pinMu.Lock()
+	defer c.pinMu.Unlock()
+
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	pe, pinned := sh.pins[hash]
+	switch {
+	case pin == pinned:
+		sh.mu.Unlock()
+		return nil
+	case pin:
+		pe = &pinEntry{}
+		sh.pins[hash] = pe
+		_, busy := sh.opMap[hash]
+		_, counted := sh.scanned[hash]
+		if !busy && (sh.scanned == nil || counted) {
+			// otherwise accounted when the operation or the scan completes
+			_, path := c.filePath(hash)
+			if finfo, err := os.Stat(path); err == nil {
+				c.addPinnedLocked(sh, hash, infounit.ByteCount(finfo.Size()))
+			}
+		}
+	default:
+		c.subPinnedLocked(sh, hash)
+		delete(sh.pins, hash)
+	}
+	sh.mu.Unlock()
+
+	if pin {
+		c.logInfo("Pinned.", logOp("pin"), logHash(hash))
+	} else {
+		c.logInfo("Unpinned.", logOp("pin"), logHash(hash))
+	}
+
+	return c.savePins()
+}
+
+// isPinned reports whether the entry for the hash is pinned.
+func (c *Cache[_]) isPinned(hash Hash) bool {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	_, pinned := sh.pins[hash]
+	return pinned
+}
+
+// addPinned accounts the file of the size added to the cache as pinned, if the
+// entry for the hash is pinned.
+func (c *Cache[_]) addPinned(hash Hash, size infounit.ByteCount) {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	c.addPinnedLocked(sh, hash, size)
+}
+
+// addPinnedLocked is the same as addPinned, but must be called with sh.mu held.
+func (c *Cache[_]) addPinnedLocked(sh *shard, hash Hash, size infounit.ByteCount) {
+	pe, pinned := sh.pins[hash]
+	if !pinned || pe.cached {
+		return
+	}
+	pe.size, pe.cached = size, true
+	c.numPinned.Add(1)
+	c.pinnedSize.Add(uint64(size))
+}
+
+// subPinnedLocked accounts the file for the hash removed from the cache, if the
+// entry is pinned. It must be called with sh.mu held.
+func (c *Cache[_]) subPinnedLocked(sh *shard, hash Hash) {
+	pe, pinned := sh.pins[hash]
+	if !pinned || !pe.cached {
+		return
+	}
+	c.numPinned.Add(^uint64(0))
+	c.pinnedSize.Add(-uint64(pe.size))
+	pe.size, pe.cached = 0, false
+}
+
+// usedSize returns the total size of the cache files counted towards MaxSize.
+// With ExcludePinnedSize, the size of the pinned files is not included.
+func (c *Cache[_]) usedSize() infounit.ByteCount {
+	total := c.totalSize.Load()
+	if c.exclPinned {
+		if pinned := c.pinnedSize.Load(); pinned < total {
+			return infounit.ByteCount(total - pinned)
+		}
+		return 0
+	}
+	return infounit.ByteCount(total)
+}
+
+// loadPins restores the pinned entries from the state file at startup, before
+// the cache files are scanned.
+func (c *Cache[_]) loadPins() error {
+	ents, err := c.readState(pinStateName)
+	if err != nil {
+		return err
+	}
+	for hash := range ents {
+		c.shard(hash).pins[hash] = &pinEntry{}
+	}
+	if len(ents) != 0 {
+		c.logInfo("Restored pinned entries.", logOp("pin"), slog.Int("entries", len(ents)))
+	}
+	return nil
+}
+
+// savePins writes the pinned entries to the state file. The caller must hold
+// c.pinMu.
+func (c *Cache[_]) savePins() error {
+	ents := make(map[Hash]string)
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for hash := range sh.pins {
+			ents[hash] = ""
+		}
+		sh.mu.Unlock()
+	}
+	if err := c.writeState(pinStateName, ents); err != nil {
+		c.logError("Failed to save pinned entries.", logOp("pin"), logErr(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Priority represents the priority class of a cache entry for eviction. GC
+// removes all the eligible files of lower priority before the ones of higher
+// priority, and in the order of the eviction policy within the same priority.
+type Priority int8
+
+const (
+	// PriorityLow is the priority of the entries to be evicted first.
+	PriorityLow Priority = -1
+
+	// PriorityNormal is the default priority.
+	PriorityNormal Priority = 0
+
+	// PriorityHigh is the priority of the entries to be evicted last.
+	PriorityHigh Priority = 1
+)
+
+// String returns the string representation of the Priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "Priority(" + strconv.Itoa(int(p)) + ")"
+}
+
+// prioStateName is the name of the state file persisting the priorities.
+const prioStateName = ".priorities" + stateSuffix
+
+// prioSet is the value suffix in the state file for the priorities set by
+// SetPriority, as opposed to the ones determined by Config.Priority.
+const prioSet = " set"
+
+// prioEntry represents the priority of a cache entry other than the default.
+type prioEntry struct {
+	prio Priority
+	set  bool // set by SetPriority, kept after the file is removed
+}
+
+// SetPriority sets the priority of the cache entry for the key, which overrides
+// the one determined by Config.Priority. The priority may be set before the
+// file is created, and is kept after the file is removed, until it is set
+// again. It is persisted in a state file in the cache directory, and restored
+// at startup. If the state file can not be written, it returns the error, while
+// the priority takes effect in memory.
+func (c *Cache[K]) SetPriority(key K, prio Priority) error {
+	if prio < PriorityLow || PriorityHigh < prio {
+		return fmt.Errorf("%w: %v", ErrInvalidPriority, prio)
+	}
+	if c.closed.Load() {
+		return ErrClosed
+	}
+
+	c.prioMu.Lock()
+	defer c.prioMu.Unlock()
+
+	hash := key.Hash()
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	sh.prios[hash] = &prioEntry{prio: prio, set: true}
+	sh.mu.Unlock()
+	c.logInfo("Priority set.", logOp("priority"), logHash(hash), logKey(key), slog.String("priority", prio.String()))
+
+	return c.savePriorities()
+}
+
+// Priority returns the current priority of the cache entry for the key.
+func (c *Cache[K]) Priority(key K) Priority {
+	return c.priority(key.Hash())
+}
+
+// priority returns the priority of the entry for the hash.
+func (c *Cache[_]) priority(hash Hash) Priority {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if pe, ok := sh.prios[hash]; ok {
+		return pe.prio
+	}
+	return PriorityNormal
+}
+
+// setPolicyPriorityLocked records the priority determined by Config.Priority
+// for the file newly created for the hash, unless the priority is set by
+// SetPriority. It must be called with sh.mu held.
+func (c *Cache[_]) setPolicyPriorityLocked(sh *shard, hash Hash, prio Priority) {
+	pe, ok := sh.prios[hash]
+	switch {
+	case ok && pe.set:
+		return
+	case prio == PriorityNormal:
+		if !ok {
+			return
+		}
+		delete(sh.prios, hash)
+	default:
+		sh.prios[hash] = &prioEntry{prio: prio}
+	}
+	c.prioDirty.Store(true)
+}
+
+// forgetPriorityLocked discards the priority of the entry for the hash whose
+// file is removed, unless it is set by SetPriority. It must be called with
+// sh.mu held.
+func (c *Cache[_]) forgetPriorityLocked(sh *shard, hash Hash) {
+	if pe, ok := sh.prios[hash]; ok && !pe.set {
+		delete(sh.prios, hash)
+		c.prioDirty.Store(true)
+	}
+}
+
+// loadPriorities restores the priorities from the state file at startup.
+func (c *Cache[_]) loadPriorities() error {
+	ents, err := c.readState(prioStateName)
+	if err != nil {
+		return err
+	}
+	for hash, val := range ents {
+		pv, set := strings.CutSuffix(val, prioSet)
+		p, err := strconv.ParseInt(pv, 10, 8)
+		if err != nil || p < int64(PriorityLow) || int64(PriorityHigh) < p {
+			continue
+		}
+		c.shard(hash).prios[hash] = &prioEntry{prio: Priority(p), set: set}
+	}
+	if len(ents) != 0 {
+		c.logInfo("Restored priorities.", logOp("priority"), slog.Int("entries", len(ents)))
+	}
+	return nil
+}
+
+// flushPriorities writes the priorities to the state file, if the ones
+// determined by Config.Priority have changed since the last write.
+func (c *Cache[_]) flushPriorities() {
+	if !c.prioDirty.Load() {
+		return
+	}
+	c.prioMu.Lock()
+	defer c.prioMu.Unlock()
+	_ = c.savePriorities()
+}
+
+// savePriorities writes the priorities to the state file. The caller must hold
+// c.prioMu.
+func (c *Cache[_]) savePriorities() error {
+	c.prioDirty.Store(false)
+	ents := make(map[Hash]string)
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for hash, pe := range sh.prios {
+			val := strconv.Itoa(int(pe.prio))
+			if pe.set {
+				val += prioSet
+			}
+			ents[hash] = val
+		}
+		sh.mu.Unlock()
+	}
+	if err := c.writeState(prioStateName, ents); err != nil {
+		c.prioDirty.Store(true) // retry on the next flush
+		c.logError("Failed to save priorities.", logOp("priority"), logErr(err))
+		return err
+	}
+	return nil
+}
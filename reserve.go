@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// fits reports whether the size can be added to the cache within MaxSize, in
+// addition to the files cached and the sizes reserved. It must be called with
+// c.resMu held.
+func (c *Cache[_]) fits(size infounit.ByteCount) bool {
+	return c.maxSize == 0 || c.usedSize()+c.reserved+size <= c.maxSize
+}
+
+// reserve reserves the size for a new file to be created. If it does not fit
+// within MaxSize, cache files are removed synchronously to make room for it.
+// With HardLimit, it waits for the other in-flight creations to complete while
+// the room can not be made, and returns ErrCacheFull if there are none left.
+func (c *Cache[K]) reserve(size infounit.ByteCount) error {
+	if size == 0 || c.maxSize == 0 {
+		return nil
+	}
+	if c.hardLimit && c.maxSize < size {
+		return fmt.Errorf("%w: %.1S larger than MaxSize", ErrCacheFull, size)
+	}
+
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+
+	for !c.fits(size) {
+		c.resMu.Unlock()
+		c.reclaim("reserve", func(infounit.ByteCount) bool {
+			c.resMu.Lock()
+			defer c.resMu.Unlock()
+			return c.fits(size)
+		})
+		c.resMu.Lock()
+
+		if c.fits(size) {
+			break
+		}
+		if !c.hardLimit {
+			c.logDebug("Reserved beyond MaxSize.", logOp("reserve"), logSize(size))
+			break
+		}
+		if c.reserved == 0 {
+			return fmt.Errorf("%w: no room for %.1S", ErrCacheFull, size)
+		}
+		c.resCond.Wait() // for the other creations to complete
+	}
+	c.reserved += size
+
+	return nil
+}
+
+// release releases the size reserved by reserve.
+func (c *Cache[_]) release(size infounit.ByteCount) {
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+	c.reserved -= size
+	c.resCond.Broadcast()
+}
+
+// addReservedFile updates the statistics for a newly created file of the size
+// added to the cache, and releases the size reserved for it at the same time,
+// so that the file is not counted twice by fits.
+func (c *Cache[_]) addReservedFile(size, reserved infounit.ByteCount) {
+	if reserved == 0 {
+		c.addFile(size)
+		return
+	}
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+	c.addFile(size)
+	c.reserved -= reserved
+	c.resCond.Broadcast()
+}
+
+// makeRoom synchronously removes unreferenced cache files, so that a new file
+// of the size can be added without exceeding MaxFiles and MaxSize. The limits
+// may still be exceeded if the files left are all referenced or pinned.
+func (c *Cache[K]) makeRoom(size infounit.ByteCount) {
+	room := func(infounit.ByteCount) bool {
+		return (c.maxFiles == 0 || c.numFiles.Load() < c.maxFiles) &&
+			(c.maxSize == 0 || c.usedSize()+size <= c.maxSize)
+	}
+	if room(0) {
+		return
+	}
+	n, freed := c.reclaim("commit", room)
+	c.logDebug("Removed cache files to make room.", logOp("commit"), slog.Int("files", n), logSize(freed))
+	if !room(0) {
+		c.logWarn("Exceeding limits, all cache files referenced or pinned.", logOp("commit"), logSize(size))
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// Ready returns the channel closed when the startup scan of the cache directory
+// completes. Without AsyncScan, it is already closed when NewWithConfig
+// returns.
+func (c *Cache[_]) Ready() <-chan struct{} { return c.ready }
+
+// isReady reports whether the startup scan has completed.
+func (c *Cache[_]) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// scanAsync runs the startup scan in the background with AsyncScan, and closes
+// c.ready when it completes. The caller must have registered it to be waited
+// for by Close.
+func (c *Cache[K]) scanAsync() {
+	defer c.active.Done()
+	defer close(c.ready)
+
+	c.gcMu.Lock()
+	defer c.gcMu.Unlock()
+
+	if err := c.scan(); err != nil && !errors.Is(err, ErrClosed) {
+		c.gcError(err)
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		sh.scanned = nil
+		sh.mu.Unlock()
+	}
+	c.logInfo("Scan completed.", logOp("scan"), slog.Uint64("scanned", c.numScanned.Load()))
+}
+
+// scan walks the cache directory to count the cache files found at startup. It
+// also removes the orphaned temporary files, and without AsyncScan, the
+// truncated cache files in durable mode and the expired cache files. The
+// walker may be called concurrently with ScanConcurrency.
+func (c *Cache[K]) scan() error {
+	var (
+		numRemoved  uint64
+		sizeRemoved infounit.ByteCount
+		numTmp      uint64
+		sizeTmp     infounit.ByteCount
+		numTorn     uint64
+		oldest      time.Time
+		deferred    []Hash // busy while scanning with AsyncScan
+		mu          sync.Mutex
+	)
+	found := func(modTime time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		if oldest.IsZero() || modTime.Before(oldest) {
+			oldest = modTime
+		}
+	}
+	async := c.asyncScan
+	scanStart := time.Now()
+	walker := func(path string, d fs.DirEntry, err error) error {
+		if async && c.closed.Load() {
+			return ErrClosed
+		}
+		switch {
+		case err != nil:
+			c.logWarn("Skip unreadable file.", logOp("scan"), logPath(path), logErr(err))
+			return fs.SkipDir
+		case d.IsDir():
+			return nil
+		}
+		fname := d.Name()
+		if strings.HasSuffix(fname, lockSuffix) || strings.HasSuffix(fname, stateSuffix) {
+			return nil
+		}
+		if thash, creating, ok := parseTmpName(fname); ok {
+			finfo, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			removed, sz, err := c.removeOrphanTmp(path, thash, creating, finfo)
+			switch {
+			case err != nil:
+				c.logError("Failed to remove orphaned temporary file.", logOp("scan"), logPath(path), logErr(err))
+			case removed:
+				c.logDebug("Removed orphaned temporary file.", logOp("scan"), logPath(path), logSize(sz))
+				mu.Lock()
+				numTmp++
+				sizeTmp += sz
+				mu.Unlock()
+			}
+			return nil
+		}
+		var hash Hash
+		if len(fname) != HashSize*2 {
+			c.logWarn("Skip unexpected file in cache dir.", logOp("scan"), logPath(path))
+			return nil
+		}
+		if _, err := hex.Decode(hash[:], []byte(fname)); err != nil {
+			c.logWarn("Skip unexpected file in cache dir.", logOp("scan"), logPath(path))
+			return nil
+		}
+		c.numScanned.Add(1)
+		if async {
+			finfo, op := c.scanFile(hash, path)
+			switch {
+			case op != nil:
+				mu.Lock()
+				deferred = append(deferred, hash)
+				mu.Unlock()
+			case finfo != nil:
+				found(finfo.ModTime())
+			}
+			return nil
+		}
+		finfo, err := d.Info()
+		if err != nil {
+			c.logError("Failed to stat.", logOp("scan"), logPath(path), logErr(err))
+			return nil
+		}
+		sz := infounit.ByteCount(finfo.Size())
+		if c.durable && isTorn(path, finfo.Size()) {
+			if err := c.removeCacheFile(path); err != nil {
+				c.logError("Failed to remove truncated cache.", logOp("scan"), logPath(path), logErr(err))
+				return nil
+			}
+			c.logWarn("Removed truncated cache.", logOp("scan"), logPath(path), logSize(sz))
+			mu.Lock()
+			numTorn++
+			mu.Unlock()
+			return nil
+		}
+		age := time.Since(finfo.ModTime())
+		if c.isPinned(hash) {
+			c.addFile(sz)
+			c.addPinned(hash, sz)
+			c.logDebug("Pinned cache found.", logOp("scan"), logPath(path), logSize(sz), logAge(age))
+			return nil
+		}
+		if c.expired(age) {
+			err := c.removeCacheFile(path)
+			switch {
+			case errors.Is(err, ErrReferenced):
+				// in use by another process, keep it
+				c.addFile(sz)
+				found(finfo.ModTime())
+				return nil
+			case err != nil:
+				c.logError("Failed to remove expired cache.", logOp("scan"), logPath(path), logErr(err))
+				return nil
+			}
+			c.logInfo("Removed expired cache.", logOp("scan"), logHash(hash), logSize(sz), logAge(age))
+			mu.Lock()
+			numRemoved++
+			sizeRemoved += sz
+			mu.Unlock()
+			c.emit(&Event[K]{Type: EventExpired, Hash: hash, Size: sz, Age: age})
+			return nil
+		}
+		c.addFile(sz)
+		found(finfo.ModTime())
+		c.logDebug("Cache found.", logOp("scan"), logPath(path), logSize(sz), logAge(age))
+
+		return nil
+	}
+	if err := c.walkCacheDir(walker); err != nil {
+		if errors.Is(err, ErrClosed) {
+			return err
+		}
+		c.logError("Failed to read cache dir.", logOp("scan"), logPath(c.dir), logErr(err))
+		return fmt.Errorf("%s: failed to read cache dir: %w", c.dir, err)
+	}
+
+	// the files being created or removed while scanned, checked again after
+	// the operations complete
+	for _, hash := range deferred {
+		for {
+			finfo, op := c.scanFile(hash, "")
+			if op == nil {
+				if finfo != nil {
+					found(finfo.ModTime())
+				}
+				break
+			}
+			select {
+			case <-op.done:
+			case <-c.closing:
+				return ErrClosed
+			}
+		}
+	}
+
+	c.setNextExpiry(scanStart, oldest)
+	if numTorn != 0 {
+		c.logWarn("Removed truncated cache files.", logOp("scan"), slog.Uint64("files", numTorn))
+	}
+	if numTmp != 0 {
+		c.numTmpRemoved.Add(numTmp)
+		c.logInfo("Removed orphaned temporary files.", logOp("scan"), slog.Uint64("files", numTmp), logSize(sizeTmp))
+	}
+	if numRemoved != 0 {
+		c.logInfo("Removed expired cache files.", logOp("scan"), slog.Uint64("files", numRemoved), logSize(sizeRemoved))
+	}
+	if n := c.numFiles.Load(); n != 0 {
+		sz := infounit.ByteCount(c.totalSize.Load())
+		c.logInfo("Found cache files.", logOp("scan"), slog.Uint64("files", n), logSize(sz))
+	}
+
+	return nil
+}
+
+// scanFile counts the cache file for the hash found by the startup scan running
+// concurrently with Get, unless it has already been counted when created. If
+// path is empty, the path for the hash is used. In durable mode, the file is
+// removed instead if truncated and not referenced. It returns the file info of
+// the file counted, or nil. If an operation for the hash is in progress, it
+// returns the operation to be waited for before checking the file again.
+func (c *Cache[_]) scanFile(hash Hash, path string) (fs.FileInfo, *opEntry) {
+	if path == "" {
+		_, path = c.filePath(hash)
+	}
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if op, busy := sh.opMap[hash]; busy {
+		return nil, op
+	}
+	if _, counted := sh.scanned[hash]; counted {
+		return nil, nil
+	}
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return nil, nil // removed concurrently
+	}
+	sz := infounit.ByteCount(finfo.Size())
+	if _, refd := sh.refMap[hash]; !refd && c.durable && isTorn(path, finfo.Size()) {
+		if err := c.removeCacheFile(path); err != nil {
+			c.logError("Failed to remove truncated cache.", logOp("scan"), logPath(path), logErr(err))
+		} else {
+			c.logWarn("Removed truncated cache.", logOp("scan"), logPath(path), logSize(sz))
+			return nil, nil
+		}
+	}
+	sh.scanned[hash] = struct{}{}
+	c.addFile(sz)
+	c.addPinnedLocked(sh, hash, sz)
+	c.logDebug("Cache found.", logOp("scan"), logPath(path), logSize(sz), logAge(time.Since(finfo.ModTime())))
+
+	return finfo, nil
+}
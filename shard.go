@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// numShards is the number of shards the states of the cache entries are split
+// into.
+const numShards = 64
+
+// shard holds the states of the cache entries whose hash values fall into it.
+// Each shard has its own lock, so that requests for different entries do not
+// block each other. The lock is only held to access the maps, and never held
+// during file system operations, except for a few on the miss path.
+type shard struct {
+	opMap   map[Hash]*opEntry
+	refMap  map[Hash]*refEntry
+	tmpRefs map[string]struct{} // temporary files returned by Get
+	costMap map[Hash]*entryCost
+	touched map[Hash]time.Time // access times not written yet
+	scanned map[Hash]struct{}  // counted during the startup scan, nil after it
+	pins    map[Hash]*pinEntry
+	prios   map[Hash]*prioEntry // other than PriorityNormal
+	removes uint64              // number of removals started by remove
+	seen    uint64              // removes as of when the last collect started
+	mu      sync.Mutex
+}
+
+// init initializes the maps of the shard.
+func (sh *shard) init() {
+	sh.opMap = make(map[Hash]*opEntry)
+	sh.refMap = make(map[Hash]*refEntry)
+	sh.tmpRefs = make(map[string]struct{})
+	sh.costMap = make(map[Hash]*entryCost)
+	sh.touched = make(map[Hash]time.Time)
+	sh.pins = make(map[Hash]*pinEntry)
+	sh.prios = make(map[Hash]*prioEntry)
+}
+
+// shard returns the shard for the hash.
+func (c *Cache[_]) shard(hash Hash) *shard {
+	return &c.shards[hash[0]%numShards]
+}
+
+// refEntry represents the references to a cache file by File objects. If the
+// file is removed while referenced, the entry is detached from the shard, and
+// the size is accounted as pending reclaim until the last reference is closed.
+type refEntry struct {
+	n        int                // number of references
+	size     infounit.ByteCount // size of the file, set when detached
+	unlinked bool               // removed while referenced
+}
+
+// refLocked increments the reference count for the hash by n, and returns the
+// entry. It must be called with sh.mu held.
+func (c *Cache[_]) refLocked(sh *shard, hash Hash, n int) *refEntry {
+	e, ok := sh.refMap[hash]
+	if !ok {
+		e = &refEntry{}
+		sh.refMap[hash] = e
+		c.numRefs.Add(1)
+	}
+	e.n += n
+	c.numFileRefs.Add(int64(n))
+	return e
+}
+
+func (c *Cache[_]) unref(hash Hash, e *refEntry) {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	c.numFileRefs.Add(-1)
+	if e.n--; e.n != 0 {
+		return
+	}
+	c.numRefs.Add(-1)
+	if e.unlinked {
+		c.pendingSize.Add(-uint64(e.size))
+		return
+	}
+	delete(sh.refMap, hash)
+}
+
+// detachRefLocked detaches the references to the cache file for the hash,
+// which has been removed while referenced. It must be called with sh.mu held.
+func (c *Cache[_]) detachRefLocked(sh *shard, hash Hash, size infounit.ByteCount) {
+	e, ok := sh.refMap[hash]
+	if !ok {
+		return
+	}
+	delete(sh.refMap, hash)
+	e.unlinked, e.size = true, size
+	c.pendingSize.Add(uint64(size))
+}
+
+// addOpLocked registers the operation for the hash. It must be called with
+// sh.mu held.
+func (c *Cache[_]) addOpLocked(sh *shard, hash Hash, op *opEntry) {
+	sh.opMap[hash] = op
+	c.numOps.Add(1)
+}
+
+// deleteOpLocked unregisters the operation for the hash. It must be called
+// with sh.mu held.
+func (c *Cache[_]) deleteOpLocked(sh *shard, hash Hash) {
+	delete(sh.opMap, hash)
+	c.numOps.Add(-1)
+}
+
+// finishOp unregisters the operation for the hash and closes the done channel
+// to wake up the waiters.
+func (c *Cache[_]) finishOp(hash Hash, op *opEntry) {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	c.deleteOpLocked(sh, hash)
+	sh.mu.Unlock()
+	close(op.done)
+}
+
+// addFile updates the statistics for a file added to the cache.
+func (c *Cache[_]) addFile(size infounit.ByteCount) {
+	c.numFiles.Add(1)
+	c.totalSize.Add(uint64(size))
+	c.sizeHist.observe(int64(size))
+}
+
+// subFile updates the statistics for a file removed from the cache.
+func (c *Cache[_]) subFile(size infounit.ByteCount) {
+	c.numFiles.Add(^uint64(0))
+	c.totalSize.Add(-uint64(size))
+	c.sizeHist.forget(int64(size))
+}
+
+// overflow reports whether the number of files or the total size exceeds the
+// limits.
+func (c *Cache[_]) overflow() bool {
+	return c.maxFiles != 0 && c.maxFiles < c.numFiles.Load() ||
+		c.maxSize != 0 && c.maxSize < c.usedSize()
+}
+
+// aboveLow reports whether the number of files or the total size exceeds the
+// low watermarks, down to which GC removes files once the limits are exceeded.
+func (c *Cache[_]) aboveLow() bool {
+	return c.maxFiles != 0 && c.lowFiles < c.numFiles.Load() ||
+		c.maxSize != 0 && c.lowSize < c.usedSize()
+}
+
+// inflationValue returns the current GreedyDual-Size inflation value.
+func (c *Cache[_]) inflationValue() float64 {
+	return math.Float64frombits(c.inflation.Load())
+}
+
+// raiseInflation raises the GreedyDual-Size inflation value to v, unless it is
+// already greater than or equal to v.
+func (c *Cache[_]) raiseInflation(v float64) {
+	for {
+		old := c.inflation.Load()
+		if v <= math.Float64frombits(old) || c.inflation.CompareAndSwap(old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+// wakeGC wakes up the GC loop in Serve, if it is waiting.
+func (c *Cache[_]) wakeGC() {
+	select {
+	case c.gcWake <- struct{}{}:
+	default:
+	}
+}
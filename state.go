@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// stateSuffix is the suffix of the state files in the cache directory, which
+// persist the states of the cache entries across restarts.
+const stateSuffix = ".state"
+
+// readState reads the state file of the name in the cache directory. Each line
+// of the file consists of the hash of an entry, optionally followed by a space
+// and the value. A missing file is read as empty. Malformed lines are skipped.
+func (c *Cache[_]) readState(name string) (map[Hash]string, error) {
+	path := filepath.Join(c.dir, name)
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return map[Hash]string{}, nil
+	case err != nil:
+		return nil, fmt.Errorf("%s: failed to read: %w", path, err)
+	}
+
+	ents := make(map[Hash]string)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		hs, val, _ := strings.Cut(sc.Text(), " ")
+		var hash Hash
+		if len(hs) != HashSize*2 {
+			continue
+		}
+		if _, err := hex.Decode(hash[:], []byte(hs)); err != nil {
+			continue
+		}
+		ents[hash] = val
+	}
+
+	return ents, nil
+}
+
+// writeState atomically replaces the state file of the name in the cache
+// directory with the entries. The values may be empty.
+func (c *Cache[_]) writeState(name string, ents map[Hash]string) error {
+	lines := make([]string, 0, len(ents))
+	for hash, val := range ents {
+		line := hex.EncodeToString(hash[:])
+		if val != "" {
+			line += " " + val
+		}
+		lines = append(lines, line+"\n")
+	}
+	sort.Strings(lines)
+
+	// the temporary name also ends with stateSuffix to be skipped by scans
+	f, err := os.CreateTemp(c.dir, name+".*"+stateSuffix)
+	if err != nil {
+		return fmt.Errorf("%s: failed to create: %w", name, err)
+	}
+	tmpPath := f.Name()
+	_, err = f.WriteString(strings.Join(lines, ""))
+	if err == nil && c.durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("%s: failed to write: %w", name, err)
+	}
+	if c.durable {
+		if err := syncDir(c.dir); err != nil {
+			c.logWarn("Failed to sync directory.", logOp("state"), logPath(c.dir), logErr(err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// Status represents the cache status and statistics.
+type Status struct {
+	NumFiles       uint64             // number of files currently in cache.
+	TotalSize      infounit.ByteCount // total size of files currently in cache.
+	NumRequested   uint64             // total number of files requested.
+	NumHit         uint64             // total number of cache hits.
+	NumCreated     uint64             // total number of newly created cache files.
+	NumFailed      uint64             // total number of operation failures.
+	NumRemoved     uint64             // total number of removed cache files.
+	NumRejected    uint64             // total number of created files not admitted.
+	NumTmpRemoved  uint64             // total number of removed orphaned temporary files.
+	NumOps         int                // number of operations currently being processed.
+	NumRefs        int                // number of currently referenced cache files.
+	PendingReclaim infounit.ByteCount // size of removed files still referenced.
+	Ready          bool               // whether the startup scan has completed.
+	NumScanned     uint64             // number of cache files found by the startup scan so far.
+	NumPinned      uint64             // number of pinned files currently in cache.
+	PinnedSize     infounit.ByteCount // total size of pinned files currently in cache.
+
+	HitLatency    *Histogram // latency of Get for cache hits, in nanoseconds.
+	CreateLatency *Histogram // time taken by CreateFunc, in nanoseconds.
+	WaitTime      *Histogram // time waiting for concurrent creation, in nanoseconds.
+	FileSize      *Histogram // size of files currently in cache, in bytes.
+}
+
+// String returns the string representation of Status.
+func (s Status) String() string {
+	return fmt.Sprintf(
+		"files=%d, size=%.1S, pinned=%d/%.1S, pending=%.1S, ready=%v, scanned=%d, req=%d, hit=%d, new=%d, fail=%d, del=%d, rej=%d, tmp-del=%d, op=%d, ref=%d, "+
+			"hit-lat=%v/%v, create=%v/%v, wait=%v/%v, fsize=%.1S/%.1S (p50/p99)",
+		s.NumFiles,
+		s.TotalSize,
+		s.NumPinned,
+		s.PinnedSize,
+		s.PendingReclaim,
+		s.Ready,
+		s.NumScanned,
+		s.NumRequested,
+		s.NumHit,
+		s.NumCreated,
+		s.NumFailed,
+		s.NumRemoved,
+		s.NumRejected,
+		s.NumTmpRemoved,
+		s.NumOps,
+		s.NumRefs,
+		time.Duration(s.HitLatency.Percentile(50)),
+		time.Duration(s.HitLatency.Percentile(99)),
+		time.Duration(s.CreateLatency.Percentile(50)),
+		time.Duration(s.CreateLatency.Percentile(99)),
+		time.Duration(s.WaitTime.Percentile(50)),
+		time.Duration(s.WaitTime.Percentile(99)),
+		infounit.ByteCount(s.FileSize.Percentile(50)),
+		infounit.ByteCount(s.FileSize.Percentile(99)),
+	)
+}
+
+// Status returns the current cache status and statistics. It does not block
+// the other operations, while the values are not a consistent snapshot taken
+// at a single point in time.
+func (c *Cache[_]) Status() *Status {
+	return &Status{
+		NumFiles:       c.numFiles.Load(),
+		TotalSize:      infounit.ByteCount(c.totalSize.Load()),
+		NumRequested:   c.numRequested.Load(),
+		NumHit:         c.numHit.Load(),
+		NumCreated:     c.numCreated.Load(),
+		NumFailed:      c.numFailed.Load(),
+		NumRemoved:     c.numRemoved.Load(),
+		NumRejected:    c.numRejected.Load(),
+		NumTmpRemoved:  c.numTmpRemoved.Load(),
+		NumOps:         int(c.numOps.Load()),
+		NumRefs:        int(c.numRefs.Load()),
+		PendingReclaim: infounit.ByteCount(c.pendingSize.Load()),
+		Ready:          c.isReady(),
+		NumScanned:     c.numScanned.Load(),
+		NumPinned:      c.numPinned.Load(),
+		PinnedSize:     infounit.ByteCount(c.pinnedSize.Load()),
+
+		HitLatency:    c.hitHist.snapshot(),
+		CreateLatency: c.createHist.snapshot(),
+		WaitTime:      c.waitHist.snapshot(),
+		FileSize:      c.sizeHist.snapshot(),
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tunabay/go-infounit"
+)
+
+// tmpSuffix is the suffix of the temporary files in the cache directory. The
+// file being created for a hash is named hash + tmpSuffix, and the file not
+// admitted into the cache is named hash + "." + random + tmpSuffix.
+const tmpSuffix = ".tmp"
+
+// defaultTmpMaxAge defines the default value for Config.TmpMaxAge.
+const defaultTmpMaxAge = time.Hour
+
+// parseTmpName parses the name of a temporary file in the cache directory. It
+// reports whether the name is of a temporary file being created for the hash.
+// It returns false for ok if the name is not of a temporary file.
+func parseTmpName(name string) (hash Hash, creating, ok bool) {
+	base, found := strings.CutSuffix(name, tmpSuffix)
+	if !found || len(base) < HashSize*2 {
+		return hash, false, false
+	}
+	if _, err := hex.Decode(hash[:], []byte(base[:HashSize*2])); err != nil {
+		return hash, false, false
+	}
+	switch rest := base[HashSize*2:]; {
+	case rest == "":
+		return hash, true, true
+	case rest[0] == '.':
+		return hash, false, true
+	}
+	return hash, false, false
+}
+
+// untmp forgets the temporary file returned by Get, which is being closed.
+func (c *Cache[_]) untmp(hash Hash, path string) {
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.tmpRefs, path)
+}
+
+// removeOrphanTmp removes the temporary file at the path, if it is older than
+// TmpMaxAge and is not in use. A temporary file being created is in use while
+// the creation operation is in progress in this process, or while another
+// process holds the create lock. A temporary file not admitted into the cache
+// is in use while it is open in this process. It reports whether the file was
+// removed and its size.
+func (c *Cache[_]) removeOrphanTmp(path string, hash Hash, creating bool, finfo fs.FileInfo) (bool, infounit.ByteCount, error) {
+	if time.Since(finfo.ModTime()) <= c.tmpMaxAge {
+		return false, 0, nil
+	}
+
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	_, opened := sh.tmpRefs[path]
+	op, busy := sh.opMap[hash]
+	sh.mu.Unlock()
+	switch {
+	case opened:
+		return false, 0, nil
+	case creating && busy && op.opType == opCreate:
+		return false, 0, nil
+	}
+
+	if creating && c.createLock {
+		lock, err := lockPath(strings.TrimSuffix(path, tmpSuffix)+lockSuffix, true)
+		switch {
+		case isWouldBlock(err):
+			return false, 0, nil // being created by another process
+		case err != nil:
+			return false, 0, err
+		}
+		defer lock.unlock()
+	}
+
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, 0, nil
+		}
+		return false, 0, err //nolint:wrapcheck
+	}
+
+	return true, infounit.ByteCount(finfo.Size()), nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// touch records the access to the cache file for the hash at path. If
+// TouchInterval is zero, it updates the modification time of the file
+// immediately. Otherwise, the access time is recorded in memory to be written
+// later by flushTouches.
+func (c *Cache[_]) touch(hash Hash, path string) {
+	tnow := time.Now()
+	if c.touchIntvl == 0 {
+		_ = os.Chtimes(path, tnow, tnow)
+		return
+	}
+	sh := c.shard(hash)
+	sh.mu.Lock()
+	sh.touched[hash] = tnow
+	sh.mu.Unlock()
+}
+
+// flushTouches writes the access times recorded in memory to the modification
+// times of the cache files. It is called from Serve.
+func (c *Cache[_]) flushTouches() {
+	var n int
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		touched := sh.touched
+		if len(touched) == 0 {
+			sh.mu.Unlock()
+			continue
+		}
+		sh.touched = make(map[Hash]time.Time)
+		sh.mu.Unlock()
+
+		for hash, t := range touched {
+			_, path := c.filePath(hash)
+			if err := os.Chtimes(path, t, t); err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					c.logWarn("Failed to update access time.", logOp("touch"), logPath(path), logErr(err))
+				}
+				continue
+			}
+			n++
+		}
+	}
+	if n != 0 {
+		c.logDebug("Wrote access times.", logOp("touch"), slog.Int("files", n))
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package filecache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// walkCacheDir walks the cache directory calling fn as filepath.WalkDir does.
+// With ScanConcurrency greater than one, the subdirectories of the cache
+// directory, each of which holds the files whose hash values share the last
+// byte, are walked in parallel by that number of goroutines. In this case, fn
+// must be safe for concurrent use, and the order of the calls is not defined.
+// The first error returned by fn stops the walk, and is returned.
+func (c *Cache[_]) walkCacheDir(fn fs.WalkDirFunc) error {
+	if c.scanConc < 2 {
+		return filepath.WalkDir(c.dir, fn) //nolint:wrapcheck
+	}
+
+	ents, err := os.ReadDir(c.dir)
+	if err != nil {
+		if err := fn(c.dir, nil, err); err != nil && !errors.Is(err, fs.SkipDir) {
+			return err
+		}
+		return nil
+	}
+
+	var (
+		subs    = make(chan string)
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		walkErr error
+		stop    = make(chan struct{})
+	)
+	for i := 0; i < c.scanConc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sub := range subs {
+				if err := filepath.WalkDir(sub, fn); err != nil {
+					errOnce.Do(func() {
+						walkErr = err
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, d := range ents {
+		path := filepath.Join(c.dir, d.Name())
+		if !d.IsDir() {
+			// files directly in the cache dir, such as the lock files
+			if err := fn(path, d, nil); err != nil && !errors.Is(err, fs.SkipDir) {
+				errOnce.Do(func() {
+					walkErr = err
+					close(stop)
+				})
+				break dispatch
+			}
+			continue
+		}
+		select {
+		case subs <- path:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(subs)
+	wg.Wait()
+
+	return walkErr
+}
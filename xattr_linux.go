@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build linux
+
+package filecache
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// sizeAttrName is the name of the extended attribute to record the size of the
+// cache file when it is committed in durable mode.
+const sizeAttrName = "user.filecache.size"
+
+// setSizeAttr records the size of the file at the path in its extended
+// attribute. It is silently ignored if the file system does not support it.
+func setSizeAttr(path string, size int64) {
+	_ = syscall.Setxattr(path, sizeAttrName, []byte(strconv.FormatInt(size, 10)), 0)
+}
+
+// getSizeAttr returns the size of the file at the path recorded by
+// setSizeAttr. It returns false for ok if not recorded.
+func getSizeAttr(path string) (int64, bool) {
+	var buf [24]byte
+	n, err := syscall.Getxattr(path, sizeAttrName, buf[:])
+	if err != nil {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(string(buf[:n]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
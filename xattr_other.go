@@ -0,0 +1,13 @@
+// Copyright (c) 2022 Hirotsuna Mizuno. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+//go:build !linux
+
+package filecache
+
+// setSizeAttr does nothing on this platform.
+func setSizeAttr(string, int64) {}
+
+// getSizeAttr always returns false for ok on this platform.
+func getSizeAttr(string) (int64, bool) { return 0, false }